@@ -0,0 +1,87 @@
+// Package broker is the message transport both APIs publish and consume
+// through. Messages keep sarama's shapes, so the same handlers work whether
+// they're talking to Kafka or something standing in for it.
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type Publisher interface {
+	// SendMessage publishes a message and returns where it landed once it's
+	// been acknowledged
+	SendMessage(m *sarama.ProducerMessage) (partition int32, offset int64, err error)
+}
+
+type Subscriber interface {
+	// Subscribe sends every message on every partition of the topic to
+	// processor until ctx is done. Each partition starts at its offset in
+	// from, or at the oldest message if it isn't there. It waits up to
+	// timeout for the topic to show up.
+	Subscribe(
+		ctx context.Context,
+		topic string,
+		timeout time.Duration,
+		from map[int32]int64,
+		processor chan<- *sarama.ConsumerMessage,
+	) error
+
+	// HighWaterMarks returns the offset of the next message to be written on
+	// each of the topic's partitions
+	HighWaterMarks(topic string) (map[int32]int64, error)
+}
+
+type Broker interface {
+	Publisher
+	Subscriber
+	Close() error
+}
+
+// KeyPartition is the partition messages with the key go to. Every Broker
+// partitions messages by key with sarama's hash partitioner.
+func KeyPartition(topic string, key string, partitions int32) (int32, error) {
+	return sarama.NewHashPartitioner(topic).Partition(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+	}, partitions)
+}
+
+// Open connects to the broker named by kind: kafka, using addrs, memory, or
+// file://path/to/dir. A file broker compacts the topics listed in a compact
+// parameter, as in file://path/to/dir?compact=topic1,topic2.
+func Open(kind string, addrs []string) (Broker, error) {
+	switch {
+	case kind == "kafka":
+		return NewKafka(addrs)
+
+	case kind == "memory":
+		return NewMemory(MemoryPartitions), nil
+
+	case strings.HasPrefix(kind, "file://"):
+		dir := strings.TrimPrefix(kind, "file://")
+
+		var compacted []string
+		if i := strings.Index(dir, "?"); i >= 0 {
+			q, err := url.ParseQuery(dir[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("bad broker %q: %s", kind, err)
+			}
+			dir = dir[:i]
+
+			for _, topics := range q["compact"] {
+				compacted = append(compacted, strings.Split(topics, ",")...)
+			}
+		}
+
+		return NewFile(dir, compacted...)
+
+	default:
+		return nil, fmt.Errorf("unknown broker %q", kind)
+	}
+}
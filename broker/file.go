@@ -0,0 +1,756 @@
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FilePartitions is how many partitions every file topic has
+	FilePartitions = 4
+	// FileSegmentBytes is how big a segment gets before a new one is started
+	FileSegmentBytes = 1 << 20
+	// FileCompactEvery is how often old segments are compacted
+	FileCompactEvery = time.Minute
+)
+
+// how often subscribers look for messages written by other processes
+const filePollInterval = 100 * time.Millisecond
+
+// every record starts with its offset, timestamp, key length and value length.
+// A length of -1 is a nil key or value.
+const recordHeaderSize = 24
+
+var errIncomplete = errors.New("incomplete record")
+
+// File is a Broker that keeps every partition of every topic as append-only
+// segment files under a directory, so topics outlive the processes using them
+// and several processes can share them. Each partition lives in
+// dir/topic/partition, and each segment is named after the offset of its
+// first record. Topics keep every record unless they're compacted, the way
+// Kafka's cleanup.policy=compact works: then segments that aren't being
+// written to any more are compacted down to the latest record for each key.
+type File struct {
+	dir        string
+	partitions int32
+	compacted  map[string]bool
+	mux        *sync.Mutex
+	tails      map[string]*fileTail
+	changed    chan struct{}
+	done       chan struct{}
+	closed     bool
+}
+
+// fileTail is where the last write to a partition left its active segment
+type fileTail struct {
+	base int64
+	pos  int64
+	next int64
+}
+
+// NewFile keeps topics under dir, compacting only the ones listed. Every
+// process sharing the directory compacts the topics it was given, so a topic
+// listed by any of them is compacted.
+func NewFile(dir string, compacted ...string) (*File, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	fb := &File{
+		dir:        dir,
+		partitions: FilePartitions,
+		compacted:  make(map[string]bool),
+		mux:        &sync.Mutex{},
+		tails:      make(map[string]*fileTail),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	for _, topic := range compacted {
+		fb.compacted[topic] = true
+	}
+
+	if len(fb.compacted) > 0 {
+		go fb.compactLoop()
+	}
+
+	return fb, nil
+}
+
+func (fb *File) Close() error {
+	fb.mux.Lock()
+	defer fb.mux.Unlock()
+
+	if !fb.closed {
+		fb.closed = true
+		close(fb.done)
+	}
+
+	return nil
+}
+
+func (fb *File) partitionDir(topic string, partition int32) string {
+	return filepath.Join(fb.dir, topic, strconv.Itoa(int(partition)))
+}
+
+// ensureTopic creates the topic's partition directories, the way brokers that
+// auto-create topics do when they're asked about one
+func (fb *File) ensureTopic(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, `/\`) || topic == "." || topic == ".." {
+		return errors.Errorf("bad topic name %q", topic)
+	}
+
+	for p := int32(0); p < fb.partitions; p++ {
+		err := os.MkdirAll(fb.partitionDir(topic, p), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fb *File) SendMessage(m *sarama.ProducerMessage) (int32, int64, error) {
+	var key, value []byte
+	var err error
+
+	if m.Key != nil {
+		key, err = m.Key.Encode()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if m.Value != nil {
+		value, err = m.Value.Encode()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	err = fb.ensureTopic(m.Topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	p, err := sarama.NewHashPartitioner(m.Topic).Partition(m, fb.partitions)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fb.mux.Lock()
+	defer fb.mux.Unlock()
+
+	if fb.closed {
+		return 0, 0, errors.New("broker is closed")
+	}
+
+	dir := fb.partitionDir(m.Topic, p)
+
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	offset, err := fb.append(dir, key, value)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	close(fb.changed)
+	fb.changed = make(chan struct{})
+
+	return p, offset, nil
+}
+
+// append writes a record to the end of a partition and returns its offset.
+// The partition's lock and fb.mux must be held.
+func (fb *File) append(dir string, key, value []byte) (int64, error) {
+	segs, err := segments(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(segs) == 0 {
+		segs = []int64{0}
+	}
+	base := segs[len(segs)-1]
+
+	f, err := os.OpenFile(segmentPath(dir, base), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		f.Close()
+	}()
+
+	// other processes may have written since we last did, so pick up from
+	// where we left off
+	tail, exists := fb.tails[dir]
+	if !exists || tail.base != base {
+		tail = &fileTail{base: base, next: base}
+	}
+
+	pos, next, err := scanSegment(f, tail.pos, tail.next)
+	if err == errIncomplete {
+		// whoever was writing it died part way through
+		err = f.Truncate(pos)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if pos >= FileSegmentBytes {
+		f.Close()
+
+		base = next
+		pos = 0
+
+		// the deferred close picks up the new segment
+		f, err = os.OpenFile(segmentPath(dir, base), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	r := encodeRecord(next, time.Now(), key, value)
+
+	_, err = f.Write(r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	fb.tails[dir] = &fileTail{
+		base: base,
+		pos:  pos + int64(len(r)),
+		next: next + 1,
+	}
+
+	return next, nil
+}
+
+func (fb *File) Subscribe(
+	ctx context.Context,
+	topic string,
+	timeout time.Duration,
+	from map[int32]int64,
+	processor chan<- *sarama.ConsumerMessage,
+) error {
+	err := fb.ensureTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	marks, err := fb.HighWaterMarks(topic)
+	if err != nil {
+		return err
+	}
+
+	for p, o := range from {
+		if p < 0 || p >= fb.partitions || o < 0 || o > marks[p] {
+			return errors.Errorf("offset %d is out of range for %s partition %d", o, topic, p)
+		}
+	}
+
+	for p := int32(0); p < fb.partitions; p++ {
+		go fb.consume(ctx, topic, p, from[p], processor)
+	}
+
+	return nil
+}
+
+func (fb *File) consume(
+	ctx context.Context,
+	topic string,
+	partition int32,
+	next int64,
+	processor chan<- *sarama.ConsumerMessage,
+) {
+	dir := fb.partitionDir(topic, partition)
+
+	for {
+		segs, err := segments(dir)
+		if err != nil {
+			log.Printf("failed to list segments in %s: %s", dir, err)
+		}
+
+		if len(segs) == 0 {
+			if !fb.wait(ctx) {
+				return
+			}
+			continue
+		}
+
+		// the segment holding next is the last one that starts at or before
+		// it. Compaction may have removed older ones entirely.
+		i := sort.Search(len(segs), func(i int) bool { return segs[i] > next }) - 1
+		if i < 0 {
+			i = 0
+		}
+
+		ok := fb.consumeSegment(ctx, dir, segs[i], topic, partition, &next, processor)
+		if !ok {
+			return
+		}
+	}
+}
+
+// consumeSegment sends a segment's records from next on, until a later
+// segment has been started. It reports false if the subscriber is done.
+func (fb *File) consumeSegment(
+	ctx context.Context,
+	dir string,
+	base int64,
+	topic string,
+	partition int32,
+	next *int64,
+	processor chan<- *sarama.ConsumerMessage,
+) bool {
+	f, err := os.Open(segmentPath(dir, base))
+	if err != nil {
+		// compacted away since it was listed
+		return fb.wait(ctx)
+	}
+	defer f.Close()
+
+	var pos int64
+	var sawNewer bool
+
+	for {
+		m, size, err := readRecordAt(f, pos)
+		if err == nil {
+			pos += size
+
+			if m.Offset < *next {
+				continue
+			}
+
+			m.Topic = topic
+			m.Partition = partition
+
+			select {
+			case processor <- m:
+			case <-ctx.Done():
+				return false
+			case <-fb.done:
+				return false
+			}
+
+			*next = m.Offset + 1
+			continue
+		}
+
+		if err != errIncomplete {
+			log.Printf("failed to read %s at %d: %s", segmentPath(dir, base), pos, err)
+			return fb.wait(ctx)
+		}
+
+		segs, err := segments(dir)
+		if err == nil && len(segs) > 0 && segs[len(segs)-1] > base {
+			// a later segment is only started once this one is finished, so
+			// one more read after seeing it picks up everything
+			if sawNewer {
+				// compaction may have dropped the last records of this one
+				for _, s := range segs {
+					if s > base {
+						if *next < s {
+							*next = s
+						}
+						break
+					}
+				}
+				return true
+			}
+			sawNewer = true
+			continue
+		}
+
+		if !fb.wait(ctx) {
+			return false
+		}
+	}
+}
+
+// wait blocks until something is written in this process, or long enough
+// that another process might have. It reports false if the subscriber is done.
+func (fb *File) wait(ctx context.Context) bool {
+	fb.mux.Lock()
+	changed := fb.changed
+	fb.mux.Unlock()
+
+	select {
+	case <-changed:
+		return true
+	case <-time.After(filePollInterval):
+		return true
+	case <-ctx.Done():
+		return false
+	case <-fb.done:
+		return false
+	}
+}
+
+func (fb *File) HighWaterMarks(topic string) (map[int32]int64, error) {
+	err := fb.ensureTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	marks := make(map[int32]int64)
+
+	for p := int32(0); p < fb.partitions; p++ {
+		dir := fb.partitionDir(topic, p)
+
+		segs, err := segments(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(segs) == 0 {
+			marks[p] = 0
+			continue
+		}
+
+		base := segs[len(segs)-1]
+
+		f, err := os.Open(segmentPath(dir, base))
+		if err != nil {
+			return nil, err
+		}
+
+		_, next, err := scanSegment(f, 0, base)
+		f.Close()
+		if err != nil && err != errIncomplete {
+			return nil, err
+		}
+
+		marks[p] = next
+	}
+
+	return marks, nil
+}
+
+func (fb *File) compactLoop() {
+	for {
+		select {
+		case <-time.After(FileCompactEvery):
+		case <-fb.done:
+			return
+		}
+
+		err := fb.Compact()
+		if err != nil {
+			log.Printf("failed to compact %s: %s", fb.dir, err)
+		}
+	}
+}
+
+// Compact rewrites every finished segment of the compacted topics so it only
+// keeps the latest record for each key. Records without a key are kept.
+func (fb *File) Compact() error {
+	for topic := range fb.compacted {
+		_, err := os.Stat(filepath.Join(fb.dir, topic))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for p := int32(0); p < fb.partitions; p++ {
+			err := fb.compactPartition(fb.partitionDir(topic, p))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (fb *File) compactPartition(dir string) error {
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	segs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+
+	// the active segment is never rewritten, but its records still count
+	// when working out which ones are the latest
+	if len(segs) < 2 {
+		return nil
+	}
+
+	latest := make(map[string]int64)
+	for _, base := range segs {
+		err := eachRecord(segmentPath(dir, base), func(m *sarama.ConsumerMessage) {
+			if m.Key != nil {
+				latest[string(m.Key)] = m.Offset
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, base := range segs[:len(segs)-1] {
+		err := compactSegment(dir, base, latest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compactSegment(dir string, base int64, latest map[string]int64) error {
+	path := segmentPath(dir, base)
+
+	var kept []byte
+	var dropped int
+
+	err := eachRecord(path, func(m *sarama.ConsumerMessage) {
+		if m.Key != nil && latest[string(m.Key)] != m.Offset {
+			dropped++
+			return
+		}
+		kept = append(kept, encodeRecord(m.Offset, m.Timestamp, m.Key, m.Value)...)
+	})
+	if err != nil {
+		return err
+	}
+
+	if dropped == 0 {
+		return nil
+	}
+
+	if len(kept) == 0 {
+		return os.Remove(path)
+	}
+
+	// subscribers reading the old file keep their copy until they're done
+	// with it
+	tmp := path + ".compacting"
+
+	err = ioutil.WriteFile(tmp, kept, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func segmentPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.log", base))
+}
+
+// segments lists the base offsets of a partition's segments, oldest first
+func segments(dir string) ([]int64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]int64, 0, len(fis))
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segs = append(segs, base)
+	}
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+
+	return segs, nil
+}
+
+// lockDir takes an exclusive lock on a partition, which is shared with other
+// processes using the same directory
+func lockDir(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func encodeRecord(offset int64, ts time.Time, key, value []byte) []byte {
+	b := make([]byte, recordHeaderSize, recordHeaderSize+len(key)+len(value))
+
+	binary.BigEndian.PutUint64(b[0:], uint64(offset))
+	binary.BigEndian.PutUint64(b[8:], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint32(b[16:], uint32(encodedLength(key)))
+	binary.BigEndian.PutUint32(b[20:], uint32(encodedLength(value)))
+
+	b = append(b, key...)
+	b = append(b, value...)
+
+	return b
+}
+
+func encodedLength(b []byte) int32 {
+	if b == nil {
+		return -1
+	}
+	return int32(len(b))
+}
+
+// readRecordAt reads the record starting at pos and returns it with its size.
+// It returns errIncomplete when the record hasn't been completely written.
+func readRecordAt(f *os.File, pos int64) (*sarama.ConsumerMessage, int64, error) {
+	h := make([]byte, recordHeaderSize)
+
+	n, err := f.ReadAt(h, pos)
+	if n < len(h) {
+		if err == nil || err == io.EOF {
+			return nil, 0, errIncomplete
+		}
+		return nil, 0, err
+	}
+
+	offset := int64(binary.BigEndian.Uint64(h[0:]))
+	ts := int64(binary.BigEndian.Uint64(h[8:]))
+	kl := int32(binary.BigEndian.Uint32(h[16:]))
+	vl := int32(binary.BigEndian.Uint32(h[20:]))
+
+	if kl < -1 || vl < -1 {
+		return nil, 0, errors.Errorf("corrupt record at %d", pos)
+	}
+
+	size := int64(recordHeaderSize)
+
+	read := func(l int32) ([]byte, error) {
+		if l < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, l)
+		if l == 0 {
+			return b, nil
+		}
+
+		n, err := f.ReadAt(b, pos+size)
+		if n < len(b) {
+			if err == nil || err == io.EOF {
+				return nil, errIncomplete
+			}
+			return nil, err
+		}
+
+		size += int64(l)
+
+		return b, nil
+	}
+
+	key, err := read(kl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	value, err := read(vl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &sarama.ConsumerMessage{
+		Key:       key,
+		Value:     value,
+		Offset:    offset,
+		Timestamp: time.Unix(0, ts),
+	}, size, nil
+}
+
+// scanSegment reads records from pos to the end of the segment and returns
+// the position after the last complete one and the offset after it. next is
+// the offset expected if there are no more records.
+func scanSegment(f *os.File, pos int64, next int64) (int64, int64, error) {
+	for {
+		m, size, err := readRecordAt(f, pos)
+		if err == errIncomplete {
+			fi, serr := f.Stat()
+			if serr != nil {
+				return pos, next, serr
+			}
+
+			if fi.Size() > pos {
+				return pos, next, errIncomplete
+			}
+
+			return pos, next, nil
+		}
+		if err != nil {
+			return pos, next, err
+		}
+
+		pos += size
+		next = m.Offset + 1
+	}
+}
+
+func eachRecord(path string, fn func(m *sarama.ConsumerMessage)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var pos int64
+	for {
+		m, size, err := readRecordAt(f, pos)
+		if err == errIncomplete {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fn(m)
+		pos += size
+	}
+}
+
+var _ Broker = &File{}
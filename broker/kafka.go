@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// Kafka is a Broker backed by a Kafka cluster
+type Kafka struct {
+	client    sarama.Client
+	producer  sarama.SyncProducer
+	mux       *sync.Mutex
+	consumers map[sarama.Consumer]bool
+}
+
+func NewKafka(addrs []string) (*Kafka, error) {
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 10
+	config.Producer.Return.Successes = true
+
+	client, err := sarama.NewClient(addrs, config)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &Kafka{
+		client:    client,
+		producer:  producer,
+		mux:       &sync.Mutex{},
+		consumers: make(map[sarama.Consumer]bool),
+	}, nil
+}
+
+func (k *Kafka) Close() error {
+	k.mux.Lock()
+	for x := range k.consumers {
+		x.Close()
+	}
+	k.mux.Unlock()
+
+	k.producer.Close()
+	return k.client.Close()
+}
+
+func (k *Kafka) SendMessage(m *sarama.ProducerMessage) (int32, int64, error) {
+	return k.producer.SendMessage(m)
+}
+
+func (k *Kafka) Subscribe(
+	ctx context.Context,
+	topic string,
+	timeout time.Duration,
+	from map[int32]int64,
+	processor chan<- *sarama.ConsumerMessage,
+) error {
+	limit := time.Now().Add(timeout)
+
+SearchLoop:
+	for {
+		// asking about the topic by name lets brokers that auto-create topics
+		// create it, so we don't wait on topics nobody has written to yet
+		err := k.client.RefreshMetadata(topic)
+		if err != nil {
+			return err
+		}
+
+		ts, err := k.client.Topics()
+		if err != nil {
+			return err
+		}
+
+		for _, t := range ts {
+			if t == topic {
+				break SearchLoop
+			}
+		}
+
+		if time.Now().After(limit) {
+			return errors.New("topic not found before timeout")
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	cons, err := sarama.NewConsumerFromClient(k.client)
+	if err != nil {
+		return err
+	}
+
+	k.mux.Lock()
+	k.consumers[cons] = true
+	k.mux.Unlock()
+
+	ps, err := cons.Partitions(topic)
+	if err != nil {
+		return err
+	}
+
+	// check every offset before consuming anything, so a bad one doesn't
+	// leave some partitions running
+	for p, o := range from {
+		oldest, err := k.client.GetOffset(topic, p, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+
+		newest, err := k.client.GetOffset(topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+
+		if o < oldest || o > newest {
+			return errors.Errorf("offset %d is out of range for %s partition %d", o, topic, p)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+
+	for _, part := range ps {
+		offset, exists := from[part]
+		if !exists {
+			offset = sarama.OffsetOldest
+		}
+
+		pcons, err := cons.ConsumePartition(topic, part, offset)
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func(p sarama.PartitionConsumer) {
+			defer wg.Done()
+
+			for {
+				select {
+				case msg := <-p.Messages():
+					select {
+					case processor <- msg:
+					case <-ctx.Done():
+						p.Close()
+						return
+					}
+
+				case <-ctx.Done():
+					p.Close()
+					return
+				}
+			}
+		}(pcons)
+	}
+
+	// a consumer can only be closed once its partition consumers are, which
+	// is when ctx is done
+	go func() {
+		wg.Wait()
+
+		k.mux.Lock()
+		delete(k.consumers, cons)
+		k.mux.Unlock()
+
+		cons.Close()
+	}()
+
+	return nil
+}
+
+func (k *Kafka) HighWaterMarks(topic string) (map[int32]int64, error) {
+	ps, err := k.client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	marks := make(map[int32]int64)
+	for _, p := range ps {
+		o, err := k.client.GetOffset(topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+
+		marks[p] = o
+	}
+
+	return marks, nil
+}
+
+var _ Broker = &Kafka{}
@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// MemoryPartitions is how many partitions Open gives each memory topic
+const MemoryPartitions = 4
+
+// Memory is a Broker that keeps every topic in process. Messages are spread
+// over partitions by key the way sarama does it, and nothing is ever dropped,
+// so every subscriber can read a topic from the start.
+type Memory struct {
+	partitions int32
+	mux        *sync.Mutex
+	topics     map[string]*memoryTopic
+	done       chan struct{}
+	closed     bool
+}
+
+type memoryTopic struct {
+	partitioner sarama.Partitioner
+	partitions  [][]*sarama.ConsumerMessage
+
+	// changed is closed and replaced whenever a message is added
+	changed chan struct{}
+}
+
+func NewMemory(partitions int32) *Memory {
+	return &Memory{
+		partitions: partitions,
+		mux:        &sync.Mutex{},
+		topics:     make(map[string]*memoryTopic),
+		done:       make(chan struct{}),
+	}
+}
+
+func (mb *Memory) Close() error {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	if !mb.closed {
+		mb.closed = true
+		close(mb.done)
+	}
+
+	return nil
+}
+
+// topic finds or creates a topic. mb.mux must be held.
+func (mb *Memory) topic(name string) *memoryTopic {
+	t, exists := mb.topics[name]
+	if !exists {
+		t = &memoryTopic{
+			partitioner: sarama.NewHashPartitioner(name),
+			partitions:  make([][]*sarama.ConsumerMessage, mb.partitions),
+			changed:     make(chan struct{}),
+		}
+		mb.topics[name] = t
+	}
+
+	return t
+}
+
+func (mb *Memory) SendMessage(m *sarama.ProducerMessage) (int32, int64, error) {
+	cm := &sarama.ConsumerMessage{
+		Topic:     m.Topic,
+		Timestamp: time.Now(),
+	}
+
+	var err error
+
+	if m.Key != nil {
+		cm.Key, err = m.Key.Encode()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// a nil value stays nil, so tombstones look the way they do coming from
+	// Kafka
+	if m.Value != nil {
+		cm.Value, err = m.Value.Encode()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	if mb.closed {
+		return 0, 0, errors.New("broker is closed")
+	}
+
+	t := mb.topic(m.Topic)
+
+	p, err := t.partitioner.Partition(m, mb.partitions)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cm.Partition = p
+	cm.Offset = int64(len(t.partitions[p]))
+	t.partitions[p] = append(t.partitions[p], cm)
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+
+	return cm.Partition, cm.Offset, nil
+}
+
+// Subscribe never has to wait, since memory topics are created as soon as
+// anything asks about them
+func (mb *Memory) Subscribe(
+	ctx context.Context,
+	topic string,
+	timeout time.Duration,
+	from map[int32]int64,
+	processor chan<- *sarama.ConsumerMessage,
+) error {
+	mb.mux.Lock()
+	t := mb.topic(topic)
+	for p, o := range from {
+		if p < 0 || p >= mb.partitions || o < 0 || o > int64(len(t.partitions[p])) {
+			mb.mux.Unlock()
+			return errors.Errorf("offset %d is out of range for %s partition %d", o, topic, p)
+		}
+	}
+	mb.mux.Unlock()
+
+	for p := int32(0); p < mb.partitions; p++ {
+		go mb.consume(ctx, topic, p, int(from[p]), processor)
+	}
+
+	return nil
+}
+
+func (mb *Memory) consume(
+	ctx context.Context,
+	topic string,
+	partition int32,
+	offset int,
+	processor chan<- *sarama.ConsumerMessage,
+) {
+	for {
+		mb.mux.Lock()
+		t := mb.topic(topic)
+		ms := t.partitions[partition]
+		changed := t.changed
+		mb.mux.Unlock()
+
+		for ; offset < len(ms); offset++ {
+			// every subscriber gets its own copy, the way every Kafka
+			// consumer decodes its own
+			m := *ms[offset]
+
+			select {
+			case processor <- &m:
+			case <-ctx.Done():
+				return
+			case <-mb.done:
+				return
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		case <-mb.done:
+			return
+		}
+	}
+}
+
+func (mb *Memory) HighWaterMarks(topic string) (map[int32]int64, error) {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	t := mb.topic(topic)
+
+	marks := make(map[int32]int64)
+	for p, ms := range t.partitions {
+		marks[int32(p)] = int64(len(ms))
+	}
+
+	return marks, nil
+}
+
+var _ Broker = &Memory{}
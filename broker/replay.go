@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// Replay reads each partition in until from its offset in from, or from the
+// oldest message, up to but not including its offset in until. Partitions
+// that aren't in until aren't read. fn gets the messages in order within each
+// partition, and returning false stops the partition early. Replay gives up
+// if nothing arrives for timeout before it's done.
+func Replay(
+	s Subscriber,
+	topic string,
+	from map[int32]int64,
+	until map[int32]int64,
+	timeout time.Duration,
+	fn func(m *sarama.ConsumerMessage) bool,
+) error {
+	marks, err := s.HighWaterMarks(topic)
+	if err != nil {
+		return err
+	}
+
+	// the partitions that aren't read start at the end, and whatever gets
+	// written to them in the meantime is ignored
+	start := make(map[int32]int64)
+	remaining := make(map[int32]int64)
+	for p, mark := range marks {
+		o, exists := from[p]
+		if end := until[p]; end > 0 && (!exists || o < end) {
+			remaining[p] = end
+			if exists {
+				start[p] = o
+			}
+			continue
+		}
+
+		start[p] = mark
+	}
+
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan *sarama.ConsumerMessage)
+
+	err = s.Subscribe(ctx, topic, timeout, start, messages)
+	if err != nil {
+		return err
+	}
+
+	for len(remaining) > 0 {
+		select {
+		case m := <-messages:
+			end, reading := remaining[m.Partition]
+			if !reading {
+				continue
+			}
+
+			// compaction can leave nothing right before the end
+			if m.Offset >= end {
+				delete(remaining, m.Partition)
+				continue
+			}
+
+			if !fn(m) || m.Offset+1 >= end {
+				delete(remaining, m.Partition)
+			}
+
+		case <-time.After(timeout):
+			return errors.Errorf("gave up replaying %s after %s without a message", topic, timeout)
+		}
+	}
+
+	return nil
+}
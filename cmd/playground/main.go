@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apiarian/migration-playground/broker"
+	original "github.com/apiarian/migration-playground/original-api"
+	shiny "github.com/apiarian/migration-playground/shiny-api"
+)
+
+var address string
+var shiny_address string
+var broker_kind string
+var brokers string
+var original_topic string
+var admin_token string
+
+func init() {
+	flag.StringVar(
+		&address,
+		"address",
+		"127.0.0.1:3000",
+		"address and port on which the original api listens for HTTP requests",
+	)
+	flag.StringVar(
+		&shiny_address,
+		"shiny-address",
+		"127.0.0.1:9000",
+		"address and port on which the shiny api listens for HTTP requests",
+	)
+	flag.StringVar(
+		&broker_kind,
+		"broker",
+		"memory",
+		"what carries the topics: memory to keep them in this process, kafka, or file://dir[?compact=topic,...] to keep them on disk in dir, compacting the listed topics",
+	)
+	flag.StringVar(
+		&brokers,
+		"brokers",
+		"127.0.0.1:9092",
+		"addresses of the kafka brokers to talk to",
+	)
+	flag.StringVar(
+		&original_topic,
+		"original-topic",
+		"things",
+		"the original topic on which things are published; the other topics are named after it",
+	)
+	flag.StringVar(
+		&admin_token,
+		"admin-token",
+		"",
+		"bearer token for the original api's /admin endpoints, which are disabled when empty",
+	)
+}
+
+// shinyConfig is how the Shiny API run next to the Original API is set up. It
+// mirrors OriginalTopic, follows ControlTopic and forwards writes to
+// OriginalAPI until things are handed off to it.
+type shinyConfig struct {
+	NewTopic      string
+	CommandTopic  string
+	ResponseTopic string
+	OriginalTopic string
+	ControlTopic  string
+	OriginalAPI   string
+}
+
+// newShinyConfig names the Shiny API's topics after the original topic
+func newShinyConfig(original_topic, control_topic, original_api string) *shinyConfig {
+	return &shinyConfig{
+		NewTopic:      original_topic + "-new",
+		CommandTopic:  original_topic + "-commands",
+		ResponseTopic: original_topic + "-responses",
+		OriginalTopic: original_topic,
+		ControlTopic:  control_topic,
+		OriginalAPI:   original_api,
+	}
+}
+
+// startShiny starts the Shiny API and its Updater on the Original API's
+// broker, and returns the Shiny API's routes. They run until done is closed.
+// The returned channel gets an error if either of them fails to start.
+func startShiny(b broker.Broker, c *shinyConfig, done <-chan struct{}) (http.Handler, <-chan error, error) {
+	kc := shiny.NewKafkaClient(b, c.NewTopic, c.CommandTopic, c.ResponseTopic, c.ControlTopic)
+
+	u, err := shiny.NewUpdater(kc, &shiny.UpdaterConfig{
+		NewTopic:      c.NewTopic,
+		CommandTopic:  c.CommandTopic,
+		ResponseTopic: c.ResponseTopic,
+		OwnsThings:    false,
+		Original:      shiny.NewOriginalClient(c.OriginalAPI),
+		OriginalTopic: c.OriginalTopic,
+		ControlTopic:  c.ControlTopic,
+		FooPolicy:     shiny.RejectFoo,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ts := shiny.NewStreamThings(kc, c.NewTopic, c.CommandTopic, c.ResponseTopic, nil, time.Minute)
+
+	errs := make(chan error, 2)
+	forward := func(c <-chan error) {
+		errs <- <-c
+	}
+	go forward(u.Start())
+	go forward(ts.Start())
+
+	go func() {
+		<-done
+		u.Stop()
+		ts.Stop()
+	}()
+
+	log.Printf("running the shiny api and its updater, mirroring %s to %s", c.OriginalTopic, c.NewTopic)
+
+	return shiny.NewRouter(ts, shiny.NewHistory(kc, c.NewTopic), shiny.NewAsOf(kc, c.NewTopic)), errs, nil
+}
+
+func main() {
+	flag.Parse()
+
+	b, err := broker.Open(broker_kind, strings.Split(brokers, ","))
+	if err != nil {
+		log.Fatal("failed to open broker: ", err)
+	}
+	defer b.Close()
+	log.Print("using the ", broker_kind, " broker")
+
+	// the shiny api can only take things over if both apis follow a control
+	// topic
+	control_topic := original_topic + "-control"
+
+	done := make(chan struct{})
+	defer close(done)
+
+	oh, err := original.StartAPI(original.NewMemoryThings(), b, &original.APIConfig{
+		OriginalTopic: original_topic,
+		ControlTopic:  control_topic,
+		AdminToken:    admin_token,
+		ShinyAPI:      "http://" + shiny_address,
+	}, done)
+	if err != nil {
+		log.Fatal("failed to start the original api: ", err)
+	}
+
+	sh, sErrs, err := startShiny(b, newShinyConfig(original_topic, control_topic, "http://"+address), done)
+	if err != nil {
+		log.Fatal("failed to start the shiny api: ", err)
+	}
+
+	go func() {
+		log.Fatal("shiny api error: ", <-sErrs)
+	}()
+
+	go func() {
+		log.Print("shiny api listening on ", shiny_address)
+		log.Fatal(http.ListenAndServe(shiny_address, sh))
+	}()
+
+	log.Print("original api listening on ", address)
+	log.Fatal(http.ListenAndServe(address, oh))
+}
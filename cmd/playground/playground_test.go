@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/broker"
+	original "github.com/apiarian/migration-playground/original-api"
+)
+
+const playgroundToken = "playground"
+
+// playground runs both apis and the updater on one memory broker, the way main
+// does
+type playground struct {
+	original *httptest.Server
+	shiny    *httptest.Server
+	done     chan struct{}
+}
+
+func startPlayground(t *testing.T) *playground {
+	b := broker.NewMemory(broker.MemoryPartitions)
+
+	// the listeners exist before the servers start, so each api can be
+	// told where the other one is
+	p := &playground{
+		original: httptest.NewUnstartedServer(nil),
+		shiny:    httptest.NewUnstartedServer(nil),
+		done:     make(chan struct{}),
+	}
+	originalURL := "http://" + p.original.Listener.Addr().String()
+	shinyURL := "http://" + p.shiny.Listener.Addr().String()
+
+	oh, err := original.StartAPI(original.NewMemoryThings(), b, &original.APIConfig{
+		OriginalTopic: "things",
+		ControlTopic:  "control",
+		AdminToken:    playgroundToken,
+		ShinyAPI:      shinyURL,
+	}, p.done)
+	if err != nil {
+		t.Fatalf("failed to start the original api: %s", err)
+	}
+
+	sh, errs, err := startShiny(b, newShinyConfig("things", "control", originalURL), p.done)
+	if err != nil {
+		t.Fatalf("failed to start the shiny api: %s", err)
+	}
+
+	go func() {
+		select {
+		case err := <-errs:
+			t.Errorf("shiny api failed: %s", err)
+		case <-p.done:
+		}
+	}()
+
+	p.original.Config.Handler = oh
+	p.original.Start()
+	p.shiny.Config.Handler = sh
+	p.shiny.Start()
+
+	return p
+}
+
+func (p *playground) Close() {
+	close(p.done)
+	p.original.Close()
+	p.shiny.Close()
+}
+
+// call sends in as JSON and decodes a successful response into out
+func call(method, url string, in interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		err := json.NewEncoder(&body).Encode(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+playgroundToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("%s %s said %s", method, url, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// eventually retries check until it passes or a few seconds have gone by
+func eventually(t *testing.T, what string, check func() error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s", what, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// shinyThing checks what the Shiny API serves for a Thing
+func shinyThing(p *playground, id int, name string, version int) func() error {
+	return func() error {
+		th, err := original.NewShinyClient(p.shiny.URL).GetThing(id)
+		if err != nil {
+			return err
+		}
+
+		if th.Name != name || th.Version != version {
+			return errors.Errorf("shiny api has %+v, want %q at version %d", th, name, version)
+		}
+
+		return nil
+	}
+}
+
+func TestPlaygroundMirrorsBothWays(t *testing.T) {
+	p := startPlayground(t)
+	defer p.Close()
+
+	var tv original.ThingView
+	err := call(http.MethodPost, p.original.URL+"/things/", &original.ThingInput{Name: "one", Foo: 1}, &tv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "create mirrored to the shiny api", shinyThing(p, tv.ID, "one", 0))
+
+	err = call(http.MethodPost, p.original.URL+"/things/0", &original.ThingInput{Name: "uno", Foo: 1, Version: 0}, &tv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "update mirrored to the shiny api", shinyThing(p, 0, "uno", 1))
+
+	// before a handoff, the shiny api forwards writes to the original api
+	th, err := original.NewShinyClient(p.shiny.URL).CreateThing("", "two", 2)
+	if err != nil {
+		t.Fatalf("failed to create through the shiny api: %s", err)
+	}
+
+	err = call(http.MethodGet, p.original.URL+"/things/1", nil, &tv)
+	if err != nil {
+		t.Fatalf("forwarded create isn't in the original api: %s", err)
+	}
+
+	if th.ID != 1 || tv.Name != "two" {
+		t.Errorf("forwarded create made %+v, and the original api has %+v", th, tv)
+	}
+
+	err = call(http.MethodDelete, p.original.URL+"/things/0?version=1", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "delete mirrored to the shiny api", func() error {
+		_, err := original.NewShinyClient(p.shiny.URL).GetThing(0)
+		if original.CodeOrDefault(err, 0) != http.StatusNotFound {
+			return errors.Errorf("got %v, want a 404", err)
+		}
+		return nil
+	})
+}
+
+func TestPlaygroundHandoff(t *testing.T) {
+	p := startPlayground(t)
+	defer p.Close()
+
+	var tv original.ThingView
+	err := call(http.MethodPost, p.original.URL+"/things/", &original.ThingInput{Name: "before", Foo: 1}, &tv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the control topic has to be caught up with before a handoff can start
+	eventually(t, "start the handoff", func() error {
+		return call(http.MethodPost, p.original.URL+"/admin/handoff?to=shiny", nil, nil)
+	})
+
+	eventually(t, "finish the handoff", func() error {
+		var cs original.ControlStateView
+		err := call(http.MethodGet, p.original.URL+"/admin/handoff", nil, &cs)
+		if err != nil {
+			return err
+		}
+
+		if cs.Owner != original.ShinyOwner || cs.Frozen {
+			return errors.Errorf("owner is %s, frozen is %t", cs.Owner, cs.Frozen)
+		}
+		return nil
+	})
+
+	// the original api proxies to the shiny api now, which applies writes
+	// itself and mints ids after the ones it mirrored
+	err = call(http.MethodPost, p.original.URL+"/things/", &original.ThingInput{Name: "after", Foo: 2}, &tv)
+	if err != nil {
+		t.Fatalf("failed to create after the handoff: %s", err)
+	}
+
+	if tv.ID != 1 {
+		t.Errorf("create after the handoff got id %d, want 1", tv.ID)
+	}
+
+	eventually(t, "create after the handoff applied by the shiny api", shinyThing(p, tv.ID, "after", 0))
+
+	var tvs []*original.ThingView
+	err = call(http.MethodGet, p.original.URL+"/things/", nil, &tvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tvs) != 2 || tvs[0].Name != "before" || tvs[1].Name != "after" {
+		t.Errorf("the original api lists %d things after the handoff, want before and after", len(tvs))
+	}
+}
@@ -0,0 +1,193 @@
+// Package history finds the messages for a key on a topic when they're asked
+// for, instead of keeping every key's messages in memory. Both APIs build
+// their Thing histories on it.
+package history
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+// DefaultKeys is how many keys an Index remembers the messages of
+const DefaultKeys = 1000
+
+// replayTimeout is how long a scan waits for the next message of a partition
+const replayTimeout = 10 * time.Second
+
+// Index reads a key's partition the first time the key is asked about, and
+// only what's been added since on later asks. It keeps the messages of the
+// most recently asked about keys, so its memory is bounded by how many keys it
+// keeps rather than by the size of the topic.
+type Index struct {
+	b     broker.Subscriber
+	topic string
+	keep  int
+
+	// everyKey picks out messages that matter to every key on a partition,
+	// like fences. They're kept for as long as the Index is around.
+	everyKey func(m *sarama.ConsumerMessage) bool
+
+	mux    *sync.Mutex
+	keys   map[string]*list.Element
+	recent *list.List
+	shared map[int32][]*sarama.ConsumerMessage
+}
+
+// keyEntry is what's known about one key. next is the offset its partition
+// has been read up to, and scan is held while reading it.
+type keyEntry struct {
+	key      string
+	scan     *sync.Mutex
+	next     int64
+	messages []*sarama.ConsumerMessage
+}
+
+// NewIndex keeps the messages of up to keep keys. everyKey may be nil.
+func NewIndex(
+	b broker.Subscriber,
+	topic string,
+	keep int,
+	everyKey func(m *sarama.ConsumerMessage) bool,
+) *Index {
+	return &Index{
+		b:        b,
+		topic:    topic,
+		keep:     keep,
+		everyKey: everyKey,
+		mux:      &sync.Mutex{},
+		keys:     make(map[string]*list.Element),
+		recent:   list.New(),
+		shared:   make(map[int32][]*sarama.ConsumerMessage),
+	}
+}
+
+// Messages is every message on the topic for the key, along with the ones
+// for every key on its partition, in the order they're on the partition.
+// It's empty if the topic has never had the key.
+func (ix *Index) Messages(key string) ([]*sarama.ConsumerMessage, error) {
+	marks, err := ix.b.HighWaterMarks(ix.topic)
+	if err != nil {
+		return nil, err
+	}
+
+	partition, err := broker.KeyPartition(ix.topic, key, int32(len(marks)))
+	if err != nil {
+		return nil, err
+	}
+
+	e := ix.entry(key)
+
+	e.scan.Lock()
+	defer e.scan.Unlock()
+
+	if e.next < marks[partition] {
+		var found []*sarama.ConsumerMessage
+		var shared []*sarama.ConsumerMessage
+
+		err := broker.Replay(
+			ix.b,
+			ix.topic,
+			map[int32]int64{partition: e.next},
+			map[int32]int64{partition: marks[partition]},
+			replayTimeout,
+			func(m *sarama.ConsumerMessage) bool {
+				if string(m.Key) == key {
+					found = append(found, m)
+				} else if ix.everyKey != nil && ix.everyKey(m) {
+					shared = append(shared, m)
+				}
+				return true
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		ix.mux.Lock()
+		e.messages = append(e.messages, found...)
+		e.next = marks[partition]
+		ix.share(partition, shared)
+		ix.mux.Unlock()
+	}
+
+	ix.mux.Lock()
+	defer ix.mux.Unlock()
+
+	return merge(e.messages, ix.shared[partition]), nil
+}
+
+// entry finds or starts the key's entry, making it the most recent and
+// forgetting the least recent key if there are too many
+func (ix *Index) entry(key string) *keyEntry {
+	ix.mux.Lock()
+	defer ix.mux.Unlock()
+
+	if el, exists := ix.keys[key]; exists {
+		ix.recent.MoveToFront(el)
+		return el.Value.(*keyEntry)
+	}
+
+	e := &keyEntry{
+		key:  key,
+		scan: &sync.Mutex{},
+	}
+	ix.keys[key] = ix.recent.PushFront(e)
+
+	for ix.recent.Len() > ix.keep {
+		oldest := ix.recent.Back()
+		ix.recent.Remove(oldest)
+		delete(ix.keys, oldest.Value.(*keyEntry).key)
+	}
+
+	return e
+}
+
+// share adds messages for every key that haven't been seen yet. Scans for
+// different keys can cover the same offsets. ix.mux must be held.
+func (ix *Index) share(partition int32, ms []*sarama.ConsumerMessage) {
+	known := make(map[int64]bool)
+	for _, m := range ix.shared[partition] {
+		known[m.Offset] = true
+	}
+
+	shared := ix.shared[partition]
+	for _, m := range ms {
+		if !known[m.Offset] {
+			shared = append(shared, m)
+			known[m.Offset] = true
+		}
+	}
+
+	sort.Slice(shared, func(i, j int) bool { return shared[i].Offset < shared[j].Offset })
+	ix.shared[partition] = shared
+}
+
+// merge puts two lists of messages from one partition, each already in
+// offset order, together in offset order. The shared ones are only included if
+// there are messages for the key.
+func merge(a, b []*sarama.ConsumerMessage) []*sarama.ConsumerMessage {
+	if len(a) == 0 {
+		return nil
+	}
+
+	ms := make([]*sarama.ConsumerMessage, 0, len(a)+len(b))
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if j == len(b) || (i < len(a) && a[i].Offset < b[j].Offset) {
+			ms = append(ms, a[i])
+			i++
+		} else {
+			ms = append(ms, b[j])
+			j++
+		}
+	}
+
+	return ms
+}
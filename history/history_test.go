@@ -0,0 +1,78 @@
+package history
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+func send(t *testing.T, b broker.Broker, key, value string) {
+	_, _, err := b.SendMessage(&sarama.ProducerMessage{
+		Topic: "things",
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.StringEncoder(value),
+	})
+	if err != nil {
+		t.Fatalf("failed to send %s=%s: %s", key, value, err)
+	}
+}
+
+func values(ms []*sarama.ConsumerMessage) string {
+	vs := make([]string, len(ms))
+	for i, m := range ms {
+		vs[i] = string(m.Value)
+	}
+
+	return strings.Join(vs, ",")
+}
+
+func TestIndexMessages(t *testing.T) {
+	b := broker.NewMemory(1)
+
+	send(t, b, "a", "a0")
+	send(t, b, "b", "b0")
+	send(t, b, "_shared", "s0")
+	send(t, b, "a", "a1")
+
+	shared := func(m *sarama.ConsumerMessage) bool {
+		return strings.HasPrefix(string(m.Key), "_")
+	}
+
+	ix := NewIndex(b, "things", 1, shared)
+
+	steps := []struct {
+		name string
+		send []string
+		key  string
+		want string
+	}{
+		{"first ask", nil, "a", "a0,s0,a1"},
+		{"only new messages are read", []string{"a", "a2", "_shared", "s1"}, "a", "a0,s0,a1,a2,s1"},
+		{"another key", nil, "b", "b0,s0,s1"},
+		{"a forgotten key is read again", nil, "a", "a0,s0,a1,a2,s1"},
+		{"unknown key", nil, "c", ""},
+	}
+
+	for _, s := range steps {
+		for i := 0; i < len(s.send); i += 2 {
+			send(t, b, s.send[i], s.send[i+1])
+		}
+
+		ms, err := ix.Messages(s.key)
+		if err != nil {
+			t.Fatalf("%s: %s", s.name, err)
+		}
+
+		got := values(ms)
+		if got != s.want {
+			t.Errorf("%s: got %q, want %q", s.name, got, s.want)
+		}
+	}
+
+	if ix.recent.Len() != 1 {
+		t.Errorf("index keeps %d keys, want 1", ix.recent.Len())
+	}
+}
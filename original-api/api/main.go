@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apiarian/migration-playground/broker"
+	original "github.com/apiarian/migration-playground/original-api"
+)
+
+var address string
+var broker_kind string
+var brokers string
+var original_topic string
+var store string
+var republish bool
+var admin_token string
+var control_topic string
+var shiny_api string
+
+func init() {
+	flag.StringVar(
+		&address,
+		"address",
+		"127.0.0.1:3000",
+		"address and port on which to listen for HTTP requests",
+	)
+	flag.StringVar(
+		&broker_kind,
+		"broker",
+		"kafka",
+		"what carries the topics: kafka, memory to keep them in this process, or file://dir[?compact=topic,...] to keep them on disk in dir, shared with every command pointed at it, compacting the listed topics",
+	)
+	flag.StringVar(
+		&brokers,
+		"brokers",
+		"127.0.0.1:9092",
+		"addresses of the kafka brokers to talk to",
+	)
+	flag.StringVar(
+		&original_topic,
+		"original-topic",
+		fmt.Sprintf("things-%d", time.Now().Unix()),
+		"the original topic on which things are published",
+	)
+	flag.StringVar(
+		&store,
+		"store",
+		"memory",
+		"where things are kept: memory or bolt://path/to/things.db",
+	)
+	flag.BoolVar(
+		&republish,
+		"republish",
+		false,
+		"publish the current state of every thing to the original topic on startup",
+	)
+	flag.StringVar(
+		&admin_token,
+		"admin-token",
+		"",
+		"bearer token for the /admin endpoints, which are disabled when empty",
+	)
+	flag.StringVar(
+		&control_topic,
+		"control-topic",
+		"",
+		"the topic that says which api owns things; the original api always does when empty",
+	)
+	flag.StringVar(
+		&shiny_api,
+		"shiny-api",
+		"",
+		"base url of the shiny api, which requests are proxied to once it owns things",
+	)
+}
+
+func main() {
+	flag.Parse()
+
+	ts, err := original.OpenThingStore(store)
+	if err != nil {
+		log.Fatal("failed to open thing store: ", err)
+	}
+	defer ts.Close()
+	log.Print("storing things in ", store)
+
+	b, err := broker.Open(broker_kind, strings.Split(brokers, ","))
+	if err != nil {
+		log.Fatal("failed to open broker: ", err)
+	}
+	defer b.Close()
+	log.Print("using the ", broker_kind, " broker")
+
+	c := &original.APIConfig{
+		OriginalTopic: original_topic,
+		ControlTopic:  control_topic,
+		AdminToken:    admin_token,
+		ShinyAPI:      shiny_api,
+		Republish:     republish,
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	h, err := original.StartAPI(ts, b, c, done)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.Handle("/", h)
+
+	log.Print("listening on ", address)
+	log.Fatal(http.ListenAndServe(address, nil))
+}
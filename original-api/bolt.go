@@ -0,0 +1,452 @@
+package original
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+var thingsBucket = []byte("things")
+var outboxBucket = []byte("outbox")
+var idempotencyBucket = []byte("idempotency")
+
+type BoltThings struct {
+	db     *bolt.DB
+	notify chan struct{}
+}
+
+func NewBoltThings(path string) (*BoltThings, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(thingsBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(outboxBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(idempotencyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltThings{
+		db:     db,
+		notify: make(chan struct{}, 1),
+	}, nil
+}
+
+func itob(i int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
+
+func getThing(b *bolt.Bucket, id int) (*Thing, error) {
+	v := b.Get(itob(id))
+	if v == nil {
+		return nil, NewCodedError(errors.New("not found"), http.StatusNotFound)
+	}
+
+	var t *Thing
+	err := json.Unmarshal(v, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func putThing(b *bolt.Bucket, t *Thing) error {
+	v, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(itob(t.ID), v)
+}
+
+// getIdempotentCreate finds the create made with a key, if it hasn't expired
+func getIdempotentCreate(b *bolt.Bucket, key string) (*IdempotentCreate, error) {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil, nil
+	}
+
+	var ic *IdempotentCreate
+	err := json.Unmarshal(v, &ic)
+	if err != nil {
+		return nil, err
+	}
+
+	if ic.Expired() {
+		return nil, b.Delete([]byte(key))
+	}
+
+	return ic, nil
+}
+
+func putIdempotentCreate(b *bolt.Bucket, key string, ic *IdempotentCreate) error {
+	v, err := json.Marshal(ic)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(key), v)
+}
+
+// recordOutboxEntry adds t to the outbox as part of the transaction that changed it
+func recordOutboxEntry(tx *bolt.Tx, t *Thing, deleted bool) (uint64, error) {
+	b := tx.Bucket(outboxBucket)
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := json.Marshal(&OutboxEntry{
+		Thing:   t,
+		Deleted: deleted,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+
+	return seq, b.Put(k, v)
+}
+
+func (bt *BoltThings) CreateThing(key string, name string, foo int) (*Thing, error) {
+	if name == "" {
+		return nil, errors.New("name must be something")
+	}
+
+	if foo == 0 {
+		return nil, errors.New("foo must not be zero")
+	}
+
+	var t *Thing
+	hash := CreateRequestHash(name, foo)
+
+	err := bt.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(thingsBucket)
+		ib := tx.Bucket(idempotencyBucket)
+
+		if key != "" {
+			ic, err := getIdempotentCreate(ib, key)
+			if err != nil {
+				return err
+			}
+
+			if ic != nil {
+				t, err = ic.Replay(hash)
+				return err
+			}
+		}
+
+		// bolt sequences start at 1, but thing ids start at 0
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		t = &Thing{
+			ID:        int(seq - 1),
+			Name:      name,
+			Foo:       foo,
+			CreatedOn: now,
+			UpdatedOn: now,
+			Version:   0,
+		}
+
+		err = putThing(b, t)
+		if err != nil {
+			return err
+		}
+
+		if key != "" {
+			err = putIdempotentCreate(ib, key, &IdempotentCreate{Thing: t, CreatedOn: now, RequestHash: hash})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = recordOutboxEntry(tx, t, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bt.poke()
+
+	return t, nil
+}
+
+func (bt *BoltThings) UpdateThing(id int, version int, name string, foo int) (*Thing, error) {
+	if name == "" {
+		return nil, errors.New("name must be something")
+	}
+
+	if foo == 0 {
+		return nil, errors.New("foo must not be zero")
+	}
+
+	var t *Thing
+
+	err := bt.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(thingsBucket)
+
+		var err error
+		t, err = getThing(b, id)
+		if err != nil {
+			return err
+		}
+
+		if t.Version != version {
+			return NewCodedError(errors.New("version conflict"), http.StatusConflict)
+		}
+
+		t.Name = name
+		t.Foo = foo
+		t.Version = t.Version + 1
+		t.UpdatedOn = time.Now()
+
+		err = putThing(b, t)
+		if err != nil {
+			return err
+		}
+
+		_, err = recordOutboxEntry(tx, t, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bt.poke()
+
+	return t, nil
+}
+
+func (bt *BoltThings) DeleteThing(id int, version int) error {
+	err := bt.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(thingsBucket)
+
+		t, err := getThing(b, id)
+		if err != nil {
+			return err
+		}
+
+		if t.Version != version {
+			return NewCodedError(errors.New("version conflict"), http.StatusConflict)
+		}
+
+		err = b.Delete(itob(id))
+		if err != nil {
+			return err
+		}
+
+		_, err = recordOutboxEntry(tx, t, true)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	bt.poke()
+
+	return nil
+}
+
+func (bt *BoltThings) GetThing(id int) (*Thing, error) {
+	var t *Thing
+
+	err := bt.db.View(func(tx *bolt.Tx) error {
+		var err error
+		t, err = getThing(tx.Bucket(thingsBucket), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (bt *BoltThings) ListThings() ([]*Thing, error) {
+	var ts []*Thing
+
+	// keys are big-endian ids, so the cursor walks them in id order
+	err := bt.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(thingsBucket).ForEach(func(k, v []byte) error {
+			var t *Thing
+			err := json.Unmarshal(v, &t)
+			if err != nil {
+				return err
+			}
+
+			ts = append(ts, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ts, nil
+}
+
+func (bt *BoltThings) poke() {
+	select {
+	case bt.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (bt *BoltThings) PendingEntries(limit int) ([]*OutboxEntry, error) {
+	var es []*OutboxEntry
+
+	err := bt.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+
+		for k, v := c.First(); k != nil && len(es) < limit; k, v = c.Next() {
+			var e *OutboxEntry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+
+			e.Seq = binary.BigEndian.Uint64(k)
+			es = append(es, e)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+func (bt *BoltThings) RecordSnapshot(from, to int) (*OutboxRange, error) {
+	or := &OutboxRange{}
+
+	err := bt.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(thingsBucket).Cursor()
+
+		for k, v := c.Seek(itob(from)); k != nil; k, v = c.Next() {
+			var t *Thing
+			err := json.Unmarshal(v, &t)
+			if err != nil {
+				return err
+			}
+
+			if to >= 0 && t.ID > to {
+				break
+			}
+
+			seq, err := recordOutboxEntry(tx, t, false)
+			if err != nil {
+				return err
+			}
+
+			if or.Count == 0 {
+				or.First = seq
+			}
+			or.Last = seq
+			or.Count = or.Count + 1
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bt.poke()
+
+	return or, nil
+}
+
+func (bt *BoltThings) MarkSent(seq uint64) error {
+	return bt.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.First() {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (bt *BoltThings) OutboxNotify() <-chan struct{} {
+	return bt.notify
+}
+
+func (bt *BoltThings) SweepIdempotentCreates() (int, error) {
+	n := 0
+
+	err := bt.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+
+		// keys can't be deleted while the cursor is walking over them
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var ic *IdempotentCreate
+			err := json.Unmarshal(v, &ic)
+			if err != nil {
+				return err
+			}
+
+			if ic.Expired() {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		n = len(expired)
+		return nil
+	})
+
+	return n, err
+}
+
+func (bt *BoltThings) Close() {
+	bt.db.Close()
+}
+
+var _ ThingService = &BoltThings{}
+var _ Outbox = &BoltThings{}
@@ -0,0 +1,452 @@
+package original
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+const (
+	OriginalOwner = "original"
+	ShinyOwner    = "shiny"
+)
+
+// every control event shares a key so they all land on one partition, in order
+const controlKey = "mastership"
+
+const (
+	// FreezeEvent asks the old master to stop taking writes
+	FreezeEvent = "freeze"
+	// FrozenEvent is the old master saying it has stopped and published
+	// everything up to Marks on its topic
+	FrozenEvent = "frozen"
+	// OwnerEvent names the master. It finishes (or aborts) a handoff.
+	OwnerEvent = "owner"
+)
+
+// ControlEvent is a message on the control topic. The shiny api's Updater
+// reads and writes the same messages.
+type ControlEvent struct {
+	Type     string          `json:"type"`
+	Handoff  string          `json:"handoff"`
+	From     string          `json:"from,omitempty"`
+	To       string          `json:"to,omitempty"`
+	Owner    string          `json:"owner,omitempty"`
+	Marks    map[int32]int64 `json:"marks,omitempty"`
+	IssuedOn time.Time       `json:"issued_on"`
+}
+
+type Handoff struct {
+	ID        string
+	From      string
+	To        string
+	Stage     string
+	StartedOn time.Time
+}
+
+// ControlState is what the control topic says about who owns Things
+type ControlState struct {
+	Owner   string
+	Frozen  bool
+	Handoff *Handoff
+}
+
+func (cs *ControlState) Apply(e *ControlEvent) {
+	switch e.Type {
+	case FreezeEvent:
+		cs.Frozen = true
+		cs.Handoff = &Handoff{
+			ID:        e.Handoff,
+			From:      e.From,
+			To:        e.To,
+			Stage:     FreezeEvent,
+			StartedOn: e.IssuedOn,
+		}
+
+	case FrozenEvent:
+		// compacted control topics only keep the latest event, so a frozen
+		// event has to be enough to rebuild the handoff on its own
+		if cs.Handoff == nil || cs.Handoff.ID != e.Handoff {
+			cs.Handoff = &Handoff{
+				ID:        e.Handoff,
+				From:      e.From,
+				To:        e.To,
+				StartedOn: e.IssuedOn,
+			}
+		}
+		cs.Frozen = true
+		cs.Handoff.Stage = FrozenEvent
+
+	case OwnerEvent:
+		cs.Owner = e.Owner
+		cs.Frozen = false
+		if cs.Handoff != nil && cs.Handoff.ID == e.Handoff {
+			cs.Handoff.Stage = OwnerEvent
+		}
+	}
+}
+
+// Mastership follows the control topic and decides whether the Original API
+// may write. When the control topic asks the Original API to freeze, it stops
+// writing, waits for the outbox to drain, and reports the marks of its topic
+// so the new master can tell when it has mirrored everything.
+type Mastership struct {
+	kc     *KafkaClient
+	ob     Outbox
+	topic  string
+	writes *sync.RWMutex
+	mux    *sync.Mutex
+	state  *ControlState
+	live   bool
+}
+
+func NewMastership(kc *KafkaClient, ob Outbox, topic string) *Mastership {
+	return &Mastership{
+		kc:     kc,
+		ob:     ob,
+		topic:  topic,
+		writes: &sync.RWMutex{},
+		mux:    &sync.Mutex{},
+		state:  &ControlState{Owner: OriginalOwner},
+	}
+}
+
+func (m *Mastership) Start() <-chan error {
+	errs := make(chan error, 1)
+
+	messages := make(chan *sarama.ConsumerMessage)
+
+	go func() {
+		err := m.kc.RegisterMessageProcessor(
+			context.Background(),
+			m.topic,
+			5*time.Minute,
+			messages,
+		)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		marks, err := m.kc.HighWaterMarks(m.topic)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		caughtUp := func() bool {
+			for _, o := range marks {
+				if o > 0 {
+					return false
+				}
+			}
+			return true
+		}
+
+		if caughtUp() {
+			m.goLive()
+		}
+
+		for cm := range messages {
+			var e *ControlEvent
+			err := json.Unmarshal(cm.Value, &e)
+			if err != nil {
+				log.Printf("trouble with control message %s-%d-%d: %s: %v", cm.Topic, cm.Partition, cm.Offset, cm.Value, err)
+			} else {
+				m.HandleControlEvent(e)
+			}
+
+			if marks[cm.Partition] > 0 && cm.Offset >= marks[cm.Partition]-1 {
+				marks[cm.Partition] = 0
+				if caughtUp() {
+					m.goLive()
+				}
+			}
+		}
+	}()
+
+	return errs
+}
+
+func (m *Mastership) goLive() {
+	m.mux.Lock()
+	m.live = true
+	m.mux.Unlock()
+
+	log.Printf("caught up with control topic %s, owner is %s", m.topic, m.State().Owner)
+
+	m.act()
+}
+
+func (m *Mastership) HandleControlEvent(e *ControlEvent) {
+	// the write lock waits for any writes in flight, so nothing sneaks in
+	// after a freeze
+	m.writes.Lock()
+	m.mux.Lock()
+	m.state.Apply(e)
+	live := m.live
+	m.mux.Unlock()
+	m.writes.Unlock()
+
+	if live {
+		m.act()
+	}
+}
+
+// act does this service's part of a handoff in progress
+func (m *Mastership) act() {
+	s := m.State()
+
+	if s.Handoff == nil || s.Handoff.Stage != FreezeEvent || s.Handoff.From != OriginalOwner {
+		return
+	}
+
+	go func(h *Handoff) {
+		for {
+			es, err := m.ob.PendingEntries(1)
+			if err == nil && len(es) == 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		marks, err := m.kc.HighWaterMarks(m.kc.publish_topic)
+		if err != nil {
+			log.Printf("failed to get marks for handoff %s: %s", h.ID, err)
+			return
+		}
+
+		err = m.kc.PublishControlEvent(&ControlEvent{
+			Type:     FrozenEvent,
+			Handoff:  h.ID,
+			From:     h.From,
+			To:       h.To,
+			Marks:    marks,
+			IssuedOn: time.Now(),
+		})
+		if err != nil {
+			log.Printf("failed to report frozen for handoff %s: %s", h.ID, err)
+		}
+	}(s.Handoff)
+}
+
+func (m *Mastership) State() *ControlState {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	s := *m.state
+	if m.state.Handoff != nil {
+		h := *m.state.Handoff
+		s.Handoff = &h
+	}
+
+	return &s
+}
+
+// CanWrite says why the Original API can't write right now, if it can't
+func (m *Mastership) CanWrite() error {
+	m.mux.Lock()
+	live := m.live
+	m.mux.Unlock()
+
+	if !live {
+		return NewCodedError(errors.New("still catching up with the control topic"), http.StatusServiceUnavailable)
+	}
+
+	s := m.State()
+
+	if s.Frozen {
+		return NewCodedError(errors.New("writes are frozen for a handoff"), http.StatusServiceUnavailable)
+	}
+
+	if s.Owner != OriginalOwner {
+		return NewCodedError(errors.Errorf("the %s api owns things now", s.Owner), http.StatusServiceUnavailable)
+	}
+
+	return nil
+}
+
+func NewHandoffID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// StartHandoff asks the current master to freeze so Things can move to the
+// other api
+func (m *Mastership) StartHandoff(to string) (*ControlState, error) {
+	s := m.State()
+
+	if to != ShinyOwner && to != OriginalOwner {
+		return nil, NewCodedError(errors.Errorf("unknown owner %q", to), http.StatusBadRequest)
+	}
+
+	if to == OriginalOwner {
+		return nil, NewCodedError(
+			errors.New("handing things back to the original api isn't supported yet"),
+			http.StatusBadRequest,
+		)
+	}
+
+	if s.Owner == to {
+		return nil, NewCodedError(errors.Errorf("the %s api already owns things", to), http.StatusConflict)
+	}
+
+	if s.Frozen {
+		return nil, NewCodedError(errors.Errorf("handoff %s is in progress", s.Handoff.ID), http.StatusConflict)
+	}
+
+	id, err := NewHandoffID()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.kc.PublishControlEvent(&ControlEvent{
+		Type:     FreezeEvent,
+		Handoff:  id,
+		From:     s.Owner,
+		To:       to,
+		IssuedOn: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.State(), nil
+}
+
+// AbortHandoff gives Things back to the old master and lifts the freeze
+func (m *Mastership) AbortHandoff() (*ControlState, error) {
+	s := m.State()
+
+	if !s.Frozen {
+		return nil, NewCodedError(errors.New("no handoff in progress"), http.StatusConflict)
+	}
+
+	err := m.kc.PublishControlEvent(&ControlEvent{
+		Type:     OwnerEvent,
+		Handoff:  s.Handoff.ID,
+		Owner:    s.Handoff.From,
+		IssuedOn: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.State(), nil
+}
+
+// OwnedThings only lets writes through to its ThingService while the Original
+// API is the master. Once the Shiny API owns things, reads and writes are
+// proxied to it when there's a ShinyClient to do so.
+type OwnedThings struct {
+	ThingService
+	m     *Mastership
+	shiny *ShinyClient
+}
+
+func NewOwnedThings(ts ThingService, m *Mastership, shiny *ShinyClient) *OwnedThings {
+	return &OwnedThings{
+		ThingService: ts,
+		m:            m,
+		shiny:        shiny,
+	}
+}
+
+// proxying reports whether requests should go to the Shiny API
+func (ot *OwnedThings) proxying() bool {
+	if ot.shiny == nil {
+		return false
+	}
+
+	ot.m.mux.Lock()
+	live := ot.m.live
+	ot.m.mux.Unlock()
+
+	s := ot.m.State()
+
+	return live && !s.Frozen && s.Owner == ShinyOwner
+}
+
+// writer picks where a write goes. ot.m.writes must be read locked.
+func (ot *OwnedThings) writer() (ThingService, error) {
+	if ot.proxying() {
+		return ot.shiny, nil
+	}
+
+	err := ot.m.CanWrite()
+	if err != nil {
+		return nil, err
+	}
+
+	return ot.ThingService, nil
+}
+
+func (ot *OwnedThings) CreateThing(key string, name string, foo int) (*Thing, error) {
+	ot.m.writes.RLock()
+	defer ot.m.writes.RUnlock()
+
+	ts, err := ot.writer()
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.CreateThing(key, name, foo)
+}
+
+func (ot *OwnedThings) UpdateThing(id int, version int, name string, foo int) (*Thing, error) {
+	ot.m.writes.RLock()
+	defer ot.m.writes.RUnlock()
+
+	ts, err := ot.writer()
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.UpdateThing(id, version, name, foo)
+}
+
+func (ot *OwnedThings) DeleteThing(id int, version int) error {
+	ot.m.writes.RLock()
+	defer ot.m.writes.RUnlock()
+
+	ts, err := ot.writer()
+	if err != nil {
+		return err
+	}
+
+	return ts.DeleteThing(id, version)
+}
+
+// the local store stops hearing about changes once the Shiny API owns things,
+// so reads are proxied too
+
+func (ot *OwnedThings) GetThing(id int) (*Thing, error) {
+	if ot.proxying() {
+		return ot.shiny.GetThing(id)
+	}
+
+	return ot.ThingService.GetThing(id)
+}
+
+func (ot *OwnedThings) ListThings() ([]*Thing, error) {
+	if ot.proxying() {
+		return ot.shiny.ListThings()
+	}
+
+	return ot.ThingService.ListThings()
+}
+
+var _ ThingService = &OwnedThings{}
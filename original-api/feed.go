@@ -0,0 +1,262 @@
+package original
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// feedBacklog is how many changes a Feed keeps for streams that resume
+const feedBacklog = 10000
+
+// feedKeepAlive is how often an idle stream gets a comment, so proxies don't
+// close it
+const feedKeepAlive = 15 * time.Second
+
+// FeedEvent is a change read from the thing topic. Thing is nil when the Thing
+// was deleted.
+type FeedEvent struct {
+	Partition int32
+	Offset    int64
+	ID        int
+	Thing     *Thing
+}
+
+// versionID is the event id of a change in a stream of one Thing. Deletes
+// don't have one.
+func (e *FeedEvent) versionID() string {
+	if e.Thing == nil {
+		return ""
+	}
+
+	return strconv.Itoa(e.Thing.Version)
+}
+
+// version is the version of the Thing after the change, or -1 once it's gone
+func (e *FeedEvent) version() int {
+	if e.Thing == nil {
+		return -1
+	}
+
+	return e.Thing.Version
+}
+
+// Position is how far each partition of the thing topic has been read: the
+// offset of the next message on each of them
+type Position map[int32]int64
+
+// String encodes the position as an event id. Clients aren't meant to look
+// inside it.
+func (pos Position) String() string {
+	if len(pos) == 0 {
+		return ""
+	}
+
+	ps := make([]int, 0, len(pos))
+	for p := range pos {
+		ps = append(ps, int(p))
+	}
+	sort.Ints(ps)
+
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		parts[i] = fmt.Sprintf("%d:%d", p, pos[int32(p)])
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, ",")))
+}
+
+func ParsePosition(s string) (Position, error) {
+	bad := NewCodedError(errors.Errorf("bad event id %q", s), http.StatusBadRequest)
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, bad
+	}
+
+	pos := make(Position)
+	for _, part := range strings.Split(string(b), ",") {
+		po := strings.SplitN(part, ":", 2)
+		if len(po) != 2 {
+			return nil, bad
+		}
+
+		p, err := strconv.ParseInt(po[0], 10, 32)
+		if err != nil {
+			return nil, bad
+		}
+
+		o, err := strconv.ParseInt(po[1], 10, 64)
+		if err != nil {
+			return nil, bad
+		}
+
+		pos[int32(p)] = o
+	}
+
+	return pos, nil
+}
+
+// Feed keeps the latest changes read from the thing topic for the stream
+// endpoint. It reads the topic rather than watching the store, so it also
+// sees what the Shiny API publishes there once it owns things.
+type Feed struct {
+	mux      *sync.Mutex
+	backlog  []*FeedEvent
+	start    Position
+	position Position
+
+	// changed is closed and replaced whenever the position moves
+	changed chan struct{}
+}
+
+// NewFeed makes a feed that's read from the given offsets on
+func NewFeed(from map[int32]int64) *Feed {
+	f := &Feed{
+		mux:      &sync.Mutex{},
+		start:    make(Position),
+		position: make(Position),
+		changed:  make(chan struct{}),
+	}
+
+	for p, o := range from {
+		f.start[p] = o
+		f.position[p] = o
+	}
+
+	return f
+}
+
+// Follow adds every change read from the thing topic
+func (f *Feed) Follow(messages <-chan *sarama.ConsumerMessage) {
+	for cm := range messages {
+		id, t, err := ThingFromMessage(cm)
+		if err != nil {
+			log.Printf("feed is skipping message %s|%d|%d: %s", cm.Topic, cm.Partition, cm.Offset, err)
+			f.skip(cm.Partition, cm.Offset)
+			continue
+		}
+
+		f.publish(&FeedEvent{
+			Partition: cm.Partition,
+			Offset:    cm.Offset,
+			ID:        id,
+			Thing:     t,
+		})
+	}
+}
+
+// ThingFromMessage decodes a message from the thing topic. The Thing is nil
+// for a tombstone.
+func ThingFromMessage(cm *sarama.ConsumerMessage) (int, *Thing, error) {
+	id, err := strconv.Atoi(string(cm.Key))
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "bad key %q", cm.Key)
+	}
+
+	if cm.Value == nil {
+		return id, nil, nil
+	}
+
+	var te ThingEntry
+	err = json.Unmarshal(cm.Value, &te)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, &Thing{
+		ID:        te.ID,
+		Name:      te.Name,
+		Foo:       te.Foo,
+		CreatedOn: te.CreatedOn,
+		UpdatedOn: te.UpdatedOn,
+		Version:   te.Version,
+	}, nil
+}
+
+// publish adds a change, dropping the oldest one once the backlog is full
+func (f *Feed) publish(e *FeedEvent) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.backlog = append(f.backlog, e)
+	if len(f.backlog) > feedBacklog {
+		old := f.backlog[0]
+		f.backlog[0] = nil
+		f.backlog = f.backlog[1:]
+		f.start[old.Partition] = old.Offset + 1
+	}
+
+	f.advance(e.Partition, e.Offset)
+}
+
+func (f *Feed) skip(partition int32, offset int64) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.advance(partition, offset)
+}
+
+// advance moves the position past a message. f.mux must be held.
+func (f *Feed) advance(partition int32, offset int64) {
+	if offset+1 > f.position[partition] {
+		f.position[partition] = offset + 1
+	}
+
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Position is where a stream starting now begins
+func (f *Feed) Position() Position {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.copyPosition()
+}
+
+// copyPosition copies the position. f.mux must be held.
+func (f *Feed) copyPosition() Position {
+	pos := make(Position)
+	for p, o := range f.position {
+		pos[p] = o
+	}
+
+	return pos
+}
+
+// Since returns the changes after a position, the position after them, and a
+// channel that's closed once there's more. It's a 410 when some of the changes
+// after the position have already been dropped.
+func (f *Feed) Since(after Position) ([]*FeedEvent, Position, <-chan struct{}, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for p, o := range f.start {
+		if after[p] < o {
+			return nil, nil, nil, NewCodedError(
+				errors.New("too far behind to resume, list things and stream again without Last-Event-ID"),
+				http.StatusGone,
+			)
+		}
+	}
+
+	var es []*FeedEvent
+	for _, e := range f.backlog {
+		if e.Offset >= after[e.Partition] {
+			es = append(es, e)
+		}
+	}
+
+	return es, f.copyPosition(), f.changed, nil
+}
@@ -1,11 +1,14 @@
-package main
+package original
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -36,6 +39,22 @@ func ViewThing(t *Thing) *ThingView {
 	}
 }
 
+// VersionView is an entry in a Thing's history. Thing is left out of the
+// entry for its deletion.
+type VersionView struct {
+	PublishedOn string     `json:"published-on"`
+	Deleted     bool       `json:"deleted,omitempty"`
+	Thing       *ThingView `json:"thing,omitempty"`
+}
+
+func ViewVersion(tv *ThingVersion) *VersionView {
+	return &VersionView{
+		PublishedOn: tv.PublishedOn.Format(time.RFC3339Nano),
+		Deleted:     tv.Thing == nil,
+		Thing:       ViewThing(tv.Thing),
+	}
+}
+
 type ThingInput struct {
 	Name    string `json:"name"`
 	Foo     int    `json:"foo"`
@@ -55,15 +74,22 @@ func CodeOrDefault(err error, def int) int {
 	return def
 }
 
+// MakeListThingsHandlerFunc lists Things, narrowed and ordered by a ListQuery
 func MakeListThingsHandlerFunc(ts ThingService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		lq, err := ParseListQuery(r)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
 		t, err := ts.ListThings()
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
 		}
 
-		WriteThings(w, t)
+		lq.WriteThings(w, lq.Apply(t))
 	}
 }
 
@@ -88,12 +114,41 @@ func MakeGetThingHandlerFunc(ts ThingService) http.HandlerFunc {
 			return
 		}
 
+		if inm := r.Header.Get("If-None-Match"); inm != "" && MatchesETag(inm, ThingETag(t), true) {
+			WriteNotModified(w, t)
+			return
+		}
+
 		WriteThing(w, t)
 	}
 }
 
+// IdempotencyKeyHeader names a create so retrying it doesn't create again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is how long an idempotency key can be
+const maxIdempotencyKey = 255
+
+func ParseIdempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKey {
+		return "", NewCodedError(
+			errors.Errorf("%s can't be longer than %d characters", IdempotencyKeyHeader, maxIdempotencyKey),
+			http.StatusBadRequest,
+		)
+	}
+
+	return key, nil
+}
+
 func MakeCreateThingHandler(ts ThingService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := ParseIdempotencyKey(r)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
 		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
 		if err != nil {
 			WriteError(w, http.StatusInternalServerError, err)
@@ -111,7 +166,7 @@ func MakeCreateThingHandler(ts ThingService) http.HandlerFunc {
 			return
 		}
 
-		t, err := ts.CreateThing(ti.Name, ti.Foo)
+		t, err := ts.CreateThing(key, ti.Name, ti.Foo)
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
@@ -153,7 +208,46 @@ func MakeUpdateThingHandlerFunc(ts ThingService) http.HandlerFunc {
 			return
 		}
 
+		// If-Match stands in for the version in the body. The store's
+		// compare-and-set checks it, and a conflict with it is a failed
+		// precondition.
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch != "" {
+			version, wildcard, err := IfMatchVersion(ifMatch)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+				return
+			}
+
+			// * only asks for the Thing to exist, so it's updated at
+			// whatever version it's at
+			if wildcard {
+				current, err := ts.GetThing(id)
+				if CodeOrDefault(err, 0) == http.StatusNotFound {
+					WriteError(w, http.StatusPreconditionFailed, err)
+					return
+				}
+				if err != nil {
+					WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+					return
+				}
+
+				version = current.Version
+			}
+
+			if hasVersion(body) && ti.Version != version {
+				WriteError(w, http.StatusBadRequest, errors.New("the version in the body doesn't agree with If-Match"))
+				return
+			}
+
+			ti.Version = version
+		}
+
 		t, err := ts.UpdateThing(id, ti.Version, ti.Name, ti.Foo)
+		if ifMatch != "" && (CodeOrDefault(err, 0) == http.StatusConflict || CodeOrDefault(err, 0) == http.StatusNotFound) {
+			WriteError(w, http.StatusPreconditionFailed, err)
+			return
+		}
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
@@ -164,6 +258,417 @@ func MakeUpdateThingHandlerFunc(ts ThingService) http.HandlerFunc {
 
 }
 
+func MakeDeleteThingHandlerFunc(ts ThingService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		i, ok := v["id"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no id in request"))
+			return
+		}
+
+		id, err := strconv.Atoi(i)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		vs := r.URL.Query().Get("version")
+		if vs == "" {
+			WriteError(w, http.StatusBadRequest, errors.New("version is required"))
+			return
+		}
+
+		version, err := strconv.Atoi(vs)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = ts.DeleteThing(id, version)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// MakeListVersionsHandlerFunc lists the versions of a Thing from its history
+func MakeListVersionsHandlerFunc(h *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		i, ok := v["id"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no id in request"))
+			return
+		}
+
+		id, err := strconv.Atoi(i)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		vs, err := h.Versions(id)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteVersions(w, vs)
+	}
+}
+
+func MakeGetVersionHandlerFunc(h *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		i, ok := v["id"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no id in request"))
+			return
+		}
+
+		id, err := strconv.Atoi(i)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ver, ok := v["version"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no version in request"))
+			return
+		}
+
+		version, err := strconv.Atoi(ver)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		tv, err := h.Version(id, version)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteThing(w, tv.Thing)
+	}
+}
+
+// MakeStreamThingsHandlerFunc streams changes to Things as server-sent events.
+// Every event's id is a position for resuming with Last-Event-ID, or the
+// Thing's version when the stream is limited to one Thing with ?id=.
+func MakeStreamThingsHandlerFunc(ts ThingService, f *Feed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fl, ok := w.(http.Flusher)
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("streaming isn't supported"))
+			return
+		}
+
+		filtered := false
+		only := 0
+		if s := r.URL.Query().Get("id"); s != "" {
+			var err error
+			only, err = strconv.Atoi(s)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, errors.Wrap(err, "failed to parse id"))
+				return
+			}
+			filtered = true
+		}
+
+		last := r.Header.Get("Last-Event-ID")
+
+		var pos Position
+		var first *FeedEvent
+		var err error
+
+		// the version of the Thing the client has, when filtered
+		version := -1
+
+		if filtered {
+			// versions only say where a single Thing's stream is, so it
+			// picks up from the current version instead of an offset
+			pos = f.Position()
+
+			if last != "" {
+				version, err = strconv.Atoi(last)
+				if err != nil {
+					WriteError(w, http.StatusBadRequest, errors.Wrap(err, "failed to parse Last-Event-ID"))
+					return
+				}
+
+				t, err := ts.GetThing(only)
+				switch {
+				case err == nil && t.Version != version:
+					first = &FeedEvent{ID: only, Thing: t}
+
+				case err != nil && CodeOrDefault(err, http.StatusInternalServerError) == http.StatusNotFound:
+					first = &FeedEvent{ID: only}
+
+				case err != nil:
+					WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+					return
+				}
+			}
+
+		} else if last != "" {
+			pos, err = ParsePosition(last)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+				return
+			}
+
+			_, _, _, err = f.Since(pos)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+				return
+			}
+
+		} else {
+			pos = f.Position()
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		if first != nil {
+			err = WriteFeedEvent(w, first.versionID(), first)
+			if err != nil {
+				return
+			}
+			version = first.version()
+		}
+		fl.Flush()
+
+		keepAlive := time.NewTicker(feedKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			es, next, changed, err := f.Since(pos)
+			if err != nil {
+				// the client gets the 410 when it reconnects
+				return
+			}
+
+			for _, e := range es {
+				pos[e.Partition] = e.Offset + 1
+
+				id := pos.String()
+				if filtered {
+					if e.ID != only || (e.Thing != nil && e.Thing.Version == version) {
+						continue
+					}
+
+					id = e.versionID()
+					version = e.version()
+				}
+
+				err = WriteFeedEvent(w, id, e)
+				if err != nil {
+					return
+				}
+			}
+
+			pos = next
+			fl.Flush()
+
+			select {
+			case <-changed:
+
+			case <-keepAlive.C:
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+				fl.Flush()
+
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+type RepublishView struct {
+	ID        int    `json:"id"`
+	From      int    `json:"from"`
+	To        *int   `json:"to"`
+	StartedOn string `json:"started-on"`
+	Total     int    `json:"total"`
+	Published int    `json:"published"`
+	Done      bool   `json:"done"`
+}
+
+func ViewRepublish(p *RepublishProgress) *RepublishView {
+	rv := &RepublishView{
+		ID:        p.Job.ID,
+		From:      p.Job.From,
+		StartedOn: p.Job.StartedOn.Format(time.RFC3339),
+		Total:     p.Total,
+		Published: p.Published,
+		Done:      p.Done(),
+	}
+
+	if p.Job.To >= 0 {
+		to := p.Job.To
+		rv.To = &to
+	}
+
+	return rv
+}
+
+func RequireAdminToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			WriteError(w, http.StatusForbidden, errors.New("admin endpoints are disabled"))
+			return
+		}
+
+		given := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			WriteError(w, http.StatusUnauthorized, errors.New("bad or missing admin token"))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func MakeRepublishHandlerFunc(rp *Republisher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to := 0, -1
+
+		q := r.URL.Query()
+
+		if f := q.Get("from"); f != "" {
+			var err error
+			from, err = strconv.Atoi(f)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		if t := q.Get("to"); t != "" {
+			var err error
+			to, err = strconv.Atoi(t)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		p, err := rp.Republish(from, to)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/admin/republish/%d", p.Job.ID))
+		WriteRepublish(w, http.StatusAccepted, p)
+	}
+}
+
+func MakeRepublishProgressHandlerFunc(rp *Republisher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		i, ok := v["id"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no id in request"))
+			return
+		}
+
+		id, err := strconv.Atoi(i)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		p, err := rp.Progress(id)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteRepublish(w, http.StatusOK, p)
+	}
+}
+
+type HandoffView struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Stage     string `json:"stage"`
+	StartedOn string `json:"started-on"`
+}
+
+type ControlStateView struct {
+	Owner   string       `json:"owner"`
+	Frozen  bool         `json:"frozen"`
+	Handoff *HandoffView `json:"handoff"`
+}
+
+func ViewControlState(cs *ControlState) *ControlStateView {
+	csv := &ControlStateView{
+		Owner:  cs.Owner,
+		Frozen: cs.Frozen,
+	}
+
+	if cs.Handoff != nil {
+		csv.Handoff = &HandoffView{
+			ID:        cs.Handoff.ID,
+			From:      cs.Handoff.From,
+			To:        cs.Handoff.To,
+			Stage:     cs.Handoff.Stage,
+			StartedOn: cs.Handoff.StartedOn.Format(time.RFC3339),
+		}
+	}
+
+	return csv
+}
+
+func MakeStartHandoffHandlerFunc(m *Mastership) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			WriteError(w, http.StatusBadRequest, errors.New("to is required"))
+			return
+		}
+
+		cs, err := m.StartHandoff(to)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteControlState(w, http.StatusAccepted, cs)
+	}
+}
+
+func MakeGetHandoffHandlerFunc(m *Mastership) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteControlState(w, http.StatusOK, m.State())
+	}
+}
+
+func MakeAbortHandoffHandlerFunc(m *Mastership) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cs, err := m.AbortHandoff()
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteControlState(w, http.StatusAccepted, cs)
+	}
+}
+
 func WriteError(w http.ResponseWriter, c int, err error) {
 	e := struct {
 		Message string `json:"error-message"`
@@ -180,7 +685,52 @@ func WriteError(w http.ResponseWriter, c int, err error) {
 	}
 }
 
+func WriteVersions(w http.ResponseWriter, vs []*ThingVersion) {
+	views := make([]*VersionView, len(vs))
+	for i, tv := range vs {
+		views[i] = ViewVersion(tv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(&views)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// WriteFeedEvent writes a change as a server-sent event. Deletes have just the
+// id of the Thing.
+func WriteFeedEvent(w io.Writer, id string, e *FeedEvent) error {
+	event := "thing"
+	var data interface{} = ViewThing(e.Thing)
+	if e.Thing == nil {
+		event = "delete"
+		data = struct {
+			ID int `json:"id"`
+		}{
+			ID: e.ID,
+		}
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		_, err = fmt.Fprintf(w, "id: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
 func WriteThing(w http.ResponseWriter, t *Thing) {
+	w.Header().Set("ETag", ThingETag(t))
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(ViewThing(t))
 	if err != nil {
@@ -188,6 +738,80 @@ func WriteThing(w http.ResponseWriter, t *Thing) {
 	}
 }
 
+// ThingETag is the entity tag of a Thing, which is its version
+func ThingETag(t *Thing) string {
+	return fmt.Sprintf("\"%d\"", t.Version)
+}
+
+// MatchesETag says whether an If-Match or If-None-Match header lists an entity
+// tag, or is *. If-None-Match compares weakly, ignoring W/ prefixes.
+func MatchesETag(header, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IfMatchVersion is the version an If-Match header names, or a wildcard for *,
+// which only asks for the Thing to exist. A compare-and-set can only check one
+// version, and a weak tag never matches an If-Match.
+func IfMatchVersion(header string) (version int, wildcard bool, err error) {
+	tag := strings.TrimSpace(header)
+	if tag == "*" {
+		return 0, true, nil
+	}
+
+	if strings.Contains(tag, ",") {
+		return 0, false, NewCodedError(errors.New("If-Match can only name one version"), http.StatusBadRequest)
+	}
+
+	if strings.HasPrefix(tag, "W/") {
+		return 0, false, NewCodedError(errors.New("If-Match can't match a weak entity tag"), http.StatusPreconditionFailed)
+	}
+
+	if len(tag) < 3 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false, NewCodedError(errors.Errorf("bad entity tag %q in If-Match", tag), http.StatusBadRequest)
+	}
+
+	version, err = strconv.Atoi(tag[1 : len(tag)-1])
+	if err != nil {
+		// every version is a number, so nothing else can match
+		return 0, false, NewCodedError(errors.Errorf("If-Match names version %s, which no Thing has", tag), http.StatusPreconditionFailed)
+	}
+
+	return version, false, nil
+}
+
+// WriteNotModified answers an If-None-Match that matches the Thing
+func WriteNotModified(w http.ResponseWriter, t *Thing) {
+	w.Header().Set("ETag", ThingETag(t))
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// hasVersion says whether a Thing's JSON has a version, since the zero value
+// can be a real one
+func hasVersion(body []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return false
+	}
+
+	_, exists := fields["version"]
+	return exists
+}
+
 func WriteThings(w http.ResponseWriter, ts []*Thing) {
 	tvs := make([]*ThingView, len(ts))
 	for i, t := range ts {
@@ -201,3 +825,23 @@ func WriteThings(w http.ResponseWriter, ts []*Thing) {
 		panic(err)
 	}
 }
+
+func WriteRepublish(w http.ResponseWriter, c int, p *RepublishProgress) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(c)
+
+	err := json.NewEncoder(w).Encode(ViewRepublish(p))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func WriteControlState(w http.ResponseWriter, c int, cs *ControlState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(c)
+
+	err := json.NewEncoder(w).Encode(ViewControlState(cs))
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,90 @@
+package original
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/history"
+)
+
+// ThingVersion is one version of a Thing as it was published to the thing
+// topic. Thing is nil for the Thing's deletion.
+type ThingVersion struct {
+	Thing       *Thing
+	Partition   int32
+	Offset      int64
+	PublishedOn time.Time
+}
+
+// History finds every version of a Thing on the thing topic when it's asked
+// for, including the ones the Shiny API publishes there once it owns things.
+// It only has what the topic has kept.
+type History struct {
+	index *history.Index
+}
+
+func NewHistory(kc *KafkaClient, topic string) *History {
+	return &History{
+		index: history.NewIndex(kc.b, topic, history.DefaultKeys, nil),
+	}
+}
+
+// Versions lists a Thing's versions, oldest first, including its deletion
+func (h *History) Versions(id int) ([]*ThingVersion, error) {
+	ms, err := h.index.Messages(strconv.Itoa(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var vs []*ThingVersion
+	for _, cm := range ms {
+		_, t, err := ThingFromMessage(cm)
+		if err != nil {
+			log.Printf("history is skipping message %s|%d|%d: %s", cm.Topic, cm.Partition, cm.Offset, err)
+			continue
+		}
+
+		// republishing can publish a version more than once, and it's only
+		// a new version the first time
+		if len(vs) > 0 {
+			last := vs[len(vs)-1]
+			if (last.Thing == nil && t == nil) ||
+				(last.Thing != nil && t != nil && last.Thing.Version == t.Version) {
+				continue
+			}
+		}
+
+		vs = append(vs, &ThingVersion{
+			Thing:       t,
+			Partition:   cm.Partition,
+			Offset:      cm.Offset,
+			PublishedOn: cm.Timestamp,
+		})
+	}
+
+	if len(vs) == 0 {
+		return nil, NewCodedError(errors.New("not found"), http.StatusNotFound)
+	}
+
+	return vs, nil
+}
+
+// Version finds one version of a Thing
+func (h *History) Version(id, version int) (*ThingVersion, error) {
+	vs, err := h.Versions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tv := range vs {
+		if tv.Thing != nil && tv.Thing.Version == version {
+			return tv, nil
+		}
+	}
+
+	return nil, NewCodedError(errors.New("not found"), http.StatusNotFound)
+}
@@ -1,12 +1,15 @@
-package main
+package original
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"strconv"
 	"time"
 
 	"github.com/Shopify/sarama"
+
+	"github.com/apiarian/migration-playground/broker"
 )
 
 type ThingEntry struct {
@@ -51,61 +54,112 @@ func EntryFromThing(t *Thing) (*ThingEntry, error) {
 	return te, te.err
 }
 
+// KafkaClient publishes and consumes the Original API's topics through a
+// broker, which is usually Kafka
 type KafkaClient struct {
-	client        sarama.Client
-	producer      sarama.SyncProducer
+	b             broker.Broker
 	publish_topic string
+	control_topic string
+}
+
+func NewKafkaClient(b broker.Broker, topic string, control_topic string) *KafkaClient {
+	return &KafkaClient{
+		b:             b,
+		publish_topic: topic,
+		control_topic: control_topic,
+	}
+}
+
+func (c *KafkaClient) Close() error {
+	return c.b.Close()
 }
 
-func NewKafkaClient(brokers []string, topic string) (*KafkaClient, error) {
-	config := sarama.NewConfig()
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Retry.Max = 10
-	config.Producer.Return.Successes = true
+func (c *KafkaClient) RegisterMessageProcessor(
+	ctx context.Context,
+	topic string,
+	timeout time.Duration,
+	processor chan<- *sarama.ConsumerMessage,
+) error {
+	return c.b.Subscribe(ctx, topic, timeout, nil, processor)
+}
 
-	client, err := sarama.NewClient(brokers, config)
+// ThingStream follows the thing topic from its current end, returning the
+// offsets it starts from
+func (c *KafkaClient) ThingStream() (<-chan *sarama.ConsumerMessage, map[int32]int64, error) {
+	marks, err := c.b.HighWaterMarks(c.publish_topic)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	producer, err := sarama.NewSyncProducerFromClient(client)
+	messages := make(chan *sarama.ConsumerMessage)
+
+	err = c.b.Subscribe(context.Background(), c.publish_topic, 5*time.Minute, marks, messages)
 	if err != nil {
-		client.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &KafkaClient{
-		client:        client,
-		producer:      producer,
-		publish_topic: topic,
-	}, nil
+	return messages, marks, nil
 }
 
-func (c *KafkaClient) Close() error {
-	c.producer.Close()
-	return c.client.Close()
+// HighWaterMarks returns the offset of the next message to be written on each
+// of the topic's partitions
+func (c *KafkaClient) HighWaterMarks(topic string) (map[int32]int64, error) {
+	return c.b.HighWaterMarks(topic)
 }
 
-func (c *KafkaClient) PublishStream(s <-chan *Thing) {
-	for {
-		select {
-		case t := <-s:
-			e, err := EntryFromThing(t)
-			if err != nil {
-				log.Printf("failed to convert thing to thing entry: %s", err)
-				continue
-			}
-
-			partition, offset, err := c.producer.SendMessage(&sarama.ProducerMessage{
-				Topic: c.publish_topic,
-				Key:   sarama.StringEncoder(strconv.Itoa(t.ID)),
-				Value: e,
-			})
-			if err != nil {
-				log.Printf("failed to publish thing (%+v): %v", t, err)
-			} else {
-				log.Printf("published thing (%+v) at things-%d-%d", t, partition, offset)
-			}
-		}
+func (c *KafkaClient) PublishControlEvent(e *ControlEvent) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.control_topic,
+		Key:   sarama.StringEncoder(controlKey),
+		Value: sarama.ByteEncoder(v),
+	})
+	if err != nil {
+		return err
 	}
+
+	log.Printf("published control event (%+v) at %s-%d-%d", e, c.control_topic, partition, offset)
+
+	return nil
+}
+
+func (c *KafkaClient) PublishThing(t *Thing) error {
+	e, err := EntryFromThing(t)
+	if err != nil {
+		return err
+	}
+
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.publish_topic,
+		Key:   sarama.StringEncoder(strconv.Itoa(t.ID)),
+		Value: e,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("published thing (%+v) at things-%d-%d", t, partition, offset)
+
+	return nil
+}
+
+// PublishTombstone publishes a null value for the thing's key, so compacted
+// topics eventually forget about it
+func (c *KafkaClient) PublishTombstone(id int) error {
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.publish_topic,
+		Key:   sarama.StringEncoder(strconv.Itoa(id)),
+		Value: nil,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("published tombstone for thing %d at things-%d-%d", id, partition, offset)
+
+	return nil
 }
@@ -1,7 +1,6 @@
-package main
+package original
 
 import (
-	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,58 +8,141 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/broker"
 )
 
-var address string
-var brokers string
-var original_topic string
-
-func init() {
-	flag.StringVar(
-		&address,
-		"address",
-		"127.0.0.1:3000",
-		"address and port on which to listen for HTTP requests",
-	)
-	flag.StringVar(
-		&brokers,
-		"brokers",
-		"127.0.0.1:9092",
-		"addresses of the kafka brokers to talk to",
-	)
-	flag.StringVar(
-		&original_topic,
-		"original-topic",
-		fmt.Sprintf("things-%d", time.Now().Unix()),
-		"the original topic on which things are published",
-	)
+type ThingStore interface {
+	ThingService
+	Outbox
+
+	// SweepIdempotentCreates drops the idempotency keys that have expired,
+	// saying how many it dropped
+	SweepIdempotentCreates() (int, error)
+
+	Close()
 }
 
-func main() {
-	flag.Parse()
+func OpenThingStore(store string) (ThingStore, error) {
+	switch {
+	case store == "memory":
+		return NewMemoryThings(), nil
 
-	ts := NewMemoryThings()
-	defer ts.Close()
+	case strings.HasPrefix(store, "bolt://"):
+		return NewBoltThings(strings.TrimPrefix(store, "bolt://"))
 
-	kc, err := NewKafkaClient(strings.Split(brokers, ","), original_topic)
-	if err != nil {
-		log.Fatal("failed to create kafka client: ", err)
+	default:
+		return nil, fmt.Errorf("unknown store %q", store)
+	}
+}
+
+// SweepIdempotentCreates drops expired idempotency keys every so often until
+// done is closed. Keys are only checked for expiry when they're reused, so
+// without it the ones that never are would be kept forever.
+func SweepIdempotentCreates(ts ThingStore, every time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+			n, err := ts.SweepIdempotentCreates()
+			if err != nil {
+				log.Print("trouble sweeping idempotency keys: ", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("dropped %d expired idempotency keys", n)
+			}
+		}
 	}
-	defer kc.Close()
+}
+
+// APIConfig is how an Original API is set up
+type APIConfig struct {
+	OriginalTopic string
+	ControlTopic  string
+	AdminToken    string
+
+	// ShinyAPI is the base url requests are proxied to once the Shiny API
+	// owns things
+	ShinyAPI string
+
+	// Republish queues every Thing to be published again on startup
+	Republish bool
+}
 
-	go kc.PublishStream(ts.ThingStream())
-	log.Print("publishing things to ", original_topic)
+// StartAPI starts the Original API's relay and followers on a thing store and
+// a broker, and returns its routes. They run until done is closed.
+func StartAPI(ts ThingStore, b broker.Broker, c *APIConfig, done <-chan struct{}) (http.Handler, error) {
+	kc := NewKafkaClient(b, c.OriginalTopic, c.ControlTopic)
+
+	go SweepIdempotentCreates(ts, idempotencySweepEvery, done)
+
+	relay := NewRelay(ts, kc)
+	go relay.Run(done)
+	log.Print("publishing things to ", c.OriginalTopic)
+
+	rp := NewRepublisher(ts, relay)
+	if c.Republish {
+		p, err := rp.Republish(0, -1)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to queue startup republish")
+		}
+		log.Printf("republishing %d things to %s", p.Total, c.OriginalTopic)
+	}
 
 	r := mux.NewRouter()
+	a := r.PathPrefix("/admin").Subrouter()
+
+	var things ThingService = ts
+
+	if c.ControlTopic != "" {
+		m := NewMastership(kc, ts, c.ControlTopic)
+		mErrs := m.Start()
+		go func() {
+			log.Fatal("control topic error: ", <-mErrs)
+		}()
+		log.Print("following mastership on ", c.ControlTopic)
+
+		var shiny *ShinyClient
+		if c.ShinyAPI != "" {
+			shiny = NewShinyClient(c.ShinyAPI)
+			log.Print("proxying to ", c.ShinyAPI, " once the shiny api owns things")
+		}
+
+		things = NewOwnedThings(ts, m, shiny)
+
+		a.HandleFunc("/handoff", RequireAdminToken(c.AdminToken, MakeStartHandoffHandlerFunc(m))).Methods(http.MethodPost)
+		a.HandleFunc("/handoff", RequireAdminToken(c.AdminToken, MakeGetHandoffHandlerFunc(m))).Methods(http.MethodGet)
+		a.HandleFunc("/handoff", RequireAdminToken(c.AdminToken, MakeAbortHandoffHandlerFunc(m))).Methods(http.MethodDelete)
+	}
+
+	changes, from, err := kc.ThingStream()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to follow %s", c.OriginalTopic)
+	}
+	feed := NewFeed(from)
+	go feed.Follow(changes)
+
+	history := NewHistory(kc, c.OriginalTopic)
 
 	t := r.PathPrefix("/things").Subrouter()
-	t.HandleFunc("/", MakeListThingsHandlerFunc(ts)).Methods(http.MethodGet)
-	t.HandleFunc("/", MakeCreateThingHandler(ts)).Methods(http.MethodPost)
-	t.HandleFunc("/{id}", MakeGetThingHandlerFunc(ts)).Methods(http.MethodGet)
-	t.HandleFunc("/{id}", MakeUpdateThingHandlerFunc(ts)).Methods(http.MethodPost)
+	t.HandleFunc("/", MakeListThingsHandlerFunc(things)).Methods(http.MethodGet)
+	t.HandleFunc("/", MakeCreateThingHandler(things)).Methods(http.MethodPost)
+	t.HandleFunc("/stream", MakeStreamThingsHandlerFunc(things, feed)).Methods(http.MethodGet)
+	t.HandleFunc("/{id}", MakeGetThingHandlerFunc(things)).Methods(http.MethodGet)
+	t.HandleFunc("/{id}", MakeUpdateThingHandlerFunc(things)).Methods(http.MethodPost)
+	t.HandleFunc("/{id}", MakeDeleteThingHandlerFunc(things)).Methods(http.MethodDelete)
+	t.HandleFunc("/{id}/versions", MakeListVersionsHandlerFunc(history)).Methods(http.MethodGet)
+	t.HandleFunc("/{id}/versions/{version}", MakeGetVersionHandlerFunc(history)).Methods(http.MethodGet)
 
-	http.Handle("/", r)
+	a.HandleFunc("/republish", RequireAdminToken(c.AdminToken, MakeRepublishHandlerFunc(rp))).Methods(http.MethodPost)
+	a.HandleFunc("/republish/{id}", RequireAdminToken(c.AdminToken, MakeRepublishProgressHandlerFunc(rp))).Methods(http.MethodGet)
 
-	log.Print("listening on ", address)
-	log.Fatal(http.ListenAndServe(address, nil))
+	return r, nil
 }
@@ -1,4 +1,4 @@
-package main
+package original
 
 import (
 	"sort"
@@ -11,18 +11,26 @@ import (
 )
 
 type MemoryThings struct {
-	store  map[int]*Thing
-	nextId int
-	mux    *sync.Mutex
-	stream chan *Thing
+	store   map[int]*Thing
+	nextId  int
+	mux     *sync.Mutex
+	outbox  []*OutboxEntry
+	nextSeq uint64
+	notify  chan struct{}
+
+	idempotent map[string]*IdempotentCreate
 }
 
 func NewMemoryThings() *MemoryThings {
 	return &MemoryThings{
-		store:  make(map[int]*Thing),
-		nextId: 0,
-		mux:    &sync.Mutex{},
-		stream: make(chan *Thing),
+		store:   make(map[int]*Thing),
+		nextId:  0,
+		mux:     &sync.Mutex{},
+		outbox:  make([]*OutboxEntry, 0),
+		nextSeq: 0,
+		notify:  make(chan struct{}, 1),
+
+		idempotent: make(map[string]*IdempotentCreate),
 	}
 }
 
@@ -42,7 +50,7 @@ func (ce codedError) Code() int {
 	return ce.code
 }
 
-func (mt *MemoryThings) CreateThing(name string, foo int) (*Thing, error) {
+func (mt *MemoryThings) CreateThing(key string, name string, foo int) (*Thing, error) {
 	if name == "" {
 		return nil, errors.New("name must be something")
 	}
@@ -54,6 +62,15 @@ func (mt *MemoryThings) CreateThing(name string, foo int) (*Thing, error) {
 	mt.mux.Lock()
 	defer mt.mux.Unlock()
 
+	hash := CreateRequestHash(name, foo)
+
+	if ic, exists := mt.idempotent[key]; exists {
+		if !ic.Expired() {
+			return ic.Replay(hash)
+		}
+		delete(mt.idempotent, key)
+	}
+
 	now := time.Now()
 	t := &Thing{
 		ID:        mt.nextId,
@@ -64,11 +81,14 @@ func (mt *MemoryThings) CreateThing(name string, foo int) (*Thing, error) {
 		Version:   0,
 	}
 	mt.store[t.ID] = t
-
-	go func(c chan<- *Thing) { c <- t }(mt.stream)
+	mt.record(t)
 
 	mt.nextId = mt.nextId + 1
 
+	if key != "" {
+		mt.idempotent[key] = &IdempotentCreate{Thing: t.Clone(), CreatedOn: now, RequestHash: hash}
+	}
+
 	return t, nil
 }
 
@@ -97,12 +117,30 @@ func (mt *MemoryThings) UpdateThing(id int, version int, name string, foo int) (
 	t.Foo = foo
 	t.Version = t.Version + 1
 	t.UpdatedOn = time.Now()
-
-	go func(c chan<- *Thing) { c <- t }(mt.stream)
+	mt.record(t)
 
 	return t, nil
 }
 
+func (mt *MemoryThings) DeleteThing(id int, version int) error {
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	t, ok := mt.store[id]
+	if !ok {
+		return NewCodedError(errors.New("not found"), http.StatusNotFound)
+	}
+
+	if t.Version != version {
+		return NewCodedError(errors.New("version conflict"), http.StatusConflict)
+	}
+
+	delete(mt.store, id)
+	mt.recordEntry(t, true)
+
+	return nil
+}
+
 func (mt *MemoryThings) GetThing(id int) (*Thing, error) {
 	mt.mux.Lock()
 	defer mt.mux.Unlock()
@@ -129,12 +167,103 @@ func (mt *MemoryThings) ListThings() ([]*Thing, error) {
 	return ts, nil
 }
 
-func (mt *MemoryThings) ThingStream() <-chan *Thing {
-	return mt.stream
+// record adds a copy of t to the outbox. mt.mux must be held.
+func (mt *MemoryThings) record(t *Thing) uint64 {
+	return mt.recordEntry(t, false)
 }
 
-func (mt *MemoryThings) Close() {
-	close(mt.stream)
+func (mt *MemoryThings) recordEntry(t *Thing, deleted bool) uint64 {
+	seq := mt.nextSeq
+
+	mt.outbox = append(mt.outbox, &OutboxEntry{
+		Seq:     seq,
+		Thing:   t.Clone(),
+		Deleted: deleted,
+	})
+	mt.nextSeq = mt.nextSeq + 1
+
+	select {
+	case mt.notify <- struct{}{}:
+	default:
+	}
+
+	return seq
 }
 
+func (mt *MemoryThings) RecordSnapshot(from, to int) (*OutboxRange, error) {
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	var ids []int
+	for id := range mt.store {
+		if id >= from && (to < 0 || id <= to) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Ints(ids)
+
+	or := &OutboxRange{}
+	for i, id := range ids {
+		seq := mt.record(mt.store[id])
+		if i == 0 {
+			or.First = seq
+		}
+		or.Last = seq
+		or.Count = or.Count + 1
+	}
+
+	return or, nil
+}
+
+func (mt *MemoryThings) PendingEntries(limit int) ([]*OutboxEntry, error) {
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	n := len(mt.outbox)
+	if n > limit {
+		n = limit
+	}
+
+	es := make([]*OutboxEntry, n)
+	copy(es, mt.outbox)
+
+	return es, nil
+}
+
+func (mt *MemoryThings) MarkSent(seq uint64) error {
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	i := 0
+	for i < len(mt.outbox) && mt.outbox[i].Seq <= seq {
+		i++
+	}
+	mt.outbox = mt.outbox[i:]
+
+	return nil
+}
+
+func (mt *MemoryThings) OutboxNotify() <-chan struct{} {
+	return mt.notify
+}
+
+func (mt *MemoryThings) SweepIdempotentCreates() (int, error) {
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	n := 0
+	for key, ic := range mt.idempotent {
+		if ic.Expired() {
+			delete(mt.idempotent, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (mt *MemoryThings) Close() {}
+
 var _ ThingService = &MemoryThings{}
+var _ Outbox = &MemoryThings{}
@@ -0,0 +1,158 @@
+package original
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// OutboxEntry is a change to a Thing that still needs to be published. Seq is
+// assigned in the same lock or transaction as the write itself, so entries
+// come out of the outbox in commit order, which is version order for any
+// single Thing. Deleted entries are published as tombstones for Thing.ID.
+type OutboxEntry struct {
+	Seq     uint64
+	Thing   *Thing
+	Deleted bool
+}
+
+// OutboxRange describes a contiguous run of outbox entries
+type OutboxRange struct {
+	First uint64
+	Last  uint64
+	Count int
+}
+
+type Outbox interface {
+	PendingEntries(limit int) ([]*OutboxEntry, error)
+	MarkSent(seq uint64) error
+	OutboxNotify() <-chan struct{}
+
+	// RecordSnapshot adds the current state of every Thing with an id between
+	// from and to (inclusive, to < 0 means no upper bound) to the outbox. It
+	// happens under the same lock as regular writes, so a concurrent update
+	// can't be published ahead of an older snapshot of the same Thing.
+	RecordSnapshot(from, to int) (*OutboxRange, error)
+}
+
+const (
+	relayBatchSize  = 100
+	relayPollPeriod = 5 * time.Second
+	relayMinBackoff = 100 * time.Millisecond
+	relayMaxBackoff = 30 * time.Second
+)
+
+// Relay moves entries from an Outbox to a topic. An entry is only marked as
+// sent once the broker has acknowledged it, and the relay never moves past an
+// entry it couldn't publish, so the topic sees every change in order.
+type Relay struct {
+	ob       Outbox
+	publish  func(*OutboxEntry) error
+	mux      *sync.Mutex
+	lastSent uint64
+	sentAny  bool
+}
+
+func NewRelay(ob Outbox, kc *KafkaClient) *Relay {
+	return &Relay{
+		ob: ob,
+		publish: func(e *OutboxEntry) error {
+			if e.Deleted {
+				return kc.PublishTombstone(e.Thing.ID)
+			}
+
+			return kc.PublishThing(e.Thing)
+		},
+		mux: &sync.Mutex{},
+	}
+}
+
+// SentCount reports how many entries of the range have been published
+func (r *Relay) SentCount(or *OutboxRange) int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if or.Count == 0 || !r.sentAny || r.lastSent < or.First {
+		return 0
+	}
+
+	if r.lastSent >= or.Last {
+		return or.Count
+	}
+
+	return int(r.lastSent-or.First) + 1
+}
+
+func (r *Relay) Run(done <-chan struct{}) {
+	for {
+		es, err := r.ob.PendingEntries(relayBatchSize)
+		if err != nil {
+			log.Printf("failed to read outbox: %s", err)
+		}
+
+		for _, e := range es {
+			if !r.deliver(e, done) {
+				return
+			}
+		}
+
+		if len(es) == relayBatchSize {
+			continue
+		}
+
+		select {
+		case <-r.ob.OutboxNotify():
+		case <-time.After(relayPollPeriod):
+		case <-done:
+			return
+		}
+	}
+}
+
+// deliver keeps trying to publish an entry until it succeeds, backing off
+// between attempts. It returns false if the relay was told to stop first.
+func (r *Relay) deliver(e *OutboxEntry, done <-chan struct{}) bool {
+	backoff := relayMinBackoff
+
+	for {
+		err := r.publish(e)
+		if err == nil {
+			break
+		}
+
+		log.Printf("failed to publish outbox entry %d (%+v), retrying in %s: %s", e.Seq, e.Thing, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return false
+		}
+
+		backoff = backoff * 2
+		if backoff > relayMaxBackoff {
+			backoff = relayMaxBackoff
+		}
+	}
+
+	r.mux.Lock()
+	r.lastSent = e.Seq
+	r.sentAny = true
+	r.mux.Unlock()
+
+	for {
+		err := r.ob.MarkSent(e.Seq)
+		if err == nil {
+			return true
+		}
+
+		// the entry will be published again if we give up here, which is
+		// harmless for consumers that compare versions
+		log.Printf("failed to mark outbox entry %d as sent: %s", e.Seq, err)
+
+		select {
+		case <-time.After(relayMinBackoff):
+		case <-done:
+			return false
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package original
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RepublishJob tracks one request to push the current state of Things back
+// onto the topic
+type RepublishJob struct {
+	ID        int
+	From      int
+	To        int
+	StartedOn time.Time
+	entries   *OutboxRange
+}
+
+type RepublishProgress struct {
+	Job       *RepublishJob
+	Total     int
+	Published int
+}
+
+func (rp *RepublishProgress) Done() bool {
+	return rp.Published >= rp.Total
+}
+
+type Republisher struct {
+	ob     Outbox
+	r      *Relay
+	mux    *sync.Mutex
+	jobs   map[int]*RepublishJob
+	nextID int
+}
+
+func NewRepublisher(ob Outbox, r *Relay) *Republisher {
+	return &Republisher{
+		ob:     ob,
+		r:      r,
+		mux:    &sync.Mutex{},
+		jobs:   make(map[int]*RepublishJob),
+		nextID: 0,
+	}
+}
+
+// Republish queues the current state of every Thing with an id in [from, to]
+// for publishing. A negative to means there's no upper bound.
+func (rp *Republisher) Republish(from, to int) (*RepublishProgress, error) {
+	if from < 0 {
+		return nil, NewCodedError(errors.New("from must not be negative"), http.StatusBadRequest)
+	}
+
+	if to >= 0 && to < from {
+		return nil, NewCodedError(errors.New("to must not be less than from"), http.StatusBadRequest)
+	}
+
+	or, err := rp.ob.RecordSnapshot(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	rp.mux.Lock()
+	j := &RepublishJob{
+		ID:        rp.nextID,
+		From:      from,
+		To:        to,
+		StartedOn: time.Now(),
+		entries:   or,
+	}
+	rp.jobs[j.ID] = j
+	rp.nextID = rp.nextID + 1
+	rp.mux.Unlock()
+
+	return rp.progress(j), nil
+}
+
+func (rp *Republisher) Progress(id int) (*RepublishProgress, error) {
+	rp.mux.Lock()
+	j, ok := rp.jobs[id]
+	rp.mux.Unlock()
+
+	if !ok {
+		return nil, NewCodedError(errors.New("not found"), http.StatusNotFound)
+	}
+
+	return rp.progress(j), nil
+}
+
+func (rp *Republisher) progress(j *RepublishJob) *RepublishProgress {
+	return &RepublishProgress{
+		Job:       j,
+		Total:     j.entries.Count,
+		Published: rp.r.SentCount(j.entries),
+	}
+}
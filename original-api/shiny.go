@@ -0,0 +1,293 @@
+package original
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ShinyThingView is a Thing the way the Shiny API's HTTP handlers show it
+type ShinyThingView struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Foo       float64 `json:"foo"`
+	CreatedOn string  `json:"created-on"`
+	UpdatedOn string  `json:"updated-on"`
+	Version   string  `json:"version"`
+}
+
+type ShinyThingInput struct {
+	Name    string  `json:"name"`
+	Foo     float64 `json:"foo"`
+	Version string  `json:"version,omitempty"`
+}
+
+// ThingFromShinyView converts a Thing from the Shiny API into one the Original
+// API can show, refusing anything that doesn't fit its schema
+func ThingFromShinyView(v *ShinyThingView) (*Thing, error) {
+	id, err := strconv.Atoi(v.ID)
+	if err != nil {
+		return nil, errors.Errorf("shiny thing id %q isn't numeric", v.ID)
+	}
+
+	ver, err := strconv.Atoi(v.Version)
+	if err != nil {
+		return nil, errors.Errorf("shiny thing %s has a non-numeric version %q", v.ID, v.Version)
+	}
+
+	if v.Foo != math.Trunc(v.Foo) || math.IsInf(v.Foo, 0) || math.IsNaN(v.Foo) {
+		return nil, errors.Errorf("shiny thing %s has a foo of %v, which isn't a whole number", v.ID, v.Foo)
+	}
+
+	c, err := time.Parse(time.RFC3339, v.CreatedOn)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := time.Parse(time.RFC3339, v.UpdatedOn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Thing{
+		ID:        id,
+		Name:      v.Name,
+		Foo:       int(v.Foo),
+		CreatedOn: c,
+		UpdatedOn: u,
+		Version:   ver,
+	}, nil
+}
+
+// ShinyClient talks to the Shiny API over HTTP, translating between the two
+// schemas, so the Original API can keep serving legacy clients once the Shiny
+// API owns things
+type ShinyClient struct {
+	base   string
+	client *http.Client
+}
+
+func NewShinyClient(base string) *ShinyClient {
+	return &ShinyClient{
+		base: base,
+		client: &http.Client{
+			// the shiny api waits up to 30s for a command to be applied
+			Timeout: 35 * time.Second,
+		},
+	}
+}
+
+// CreateThing passes the idempotency key along, so the Shiny API remembers it
+func (sc *ShinyClient) CreateThing(key string, name string, foo int) (*Thing, error) {
+	h := make(http.Header)
+	if key != "" {
+		h.Set(IdempotencyKeyHeader, key)
+	}
+
+	var v *ShinyThingView
+	err := sc.send(http.MethodPost, "/things/", h, &ShinyThingInput{Name: name, Foo: float64(foo)}, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.thing(v)
+}
+
+func (sc *ShinyClient) UpdateThing(id int, version int, name string, foo int) (*Thing, error) {
+	var v *ShinyThingView
+	err := sc.do(
+		http.MethodPatch,
+		fmt.Sprintf("/things/%d", id),
+		&ShinyThingInput{Name: name, Foo: float64(foo), Version: strconv.Itoa(version)},
+		&v,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.thing(v)
+}
+
+func (sc *ShinyClient) DeleteThing(id int, version int) error {
+	return sc.do(http.MethodDelete, fmt.Sprintf("/things/%d?version=%d", id, version), nil, nil)
+}
+
+func (sc *ShinyClient) GetThing(id int) (*Thing, error) {
+	var v *ShinyThingView
+	err := sc.do(http.MethodGet, fmt.Sprintf("/things/%d", id), nil, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.thing(v)
+}
+
+// listPageSize is how many Things ListThings asks the Shiny API for at a time,
+// so a page fits in maxResponseBody
+const listPageSize = 100
+
+// ListThings walks the Shiny API's pages, following each page's next link.
+// It leaves out the Things that can't be shown in the Original API's schema.
+func (sc *ShinyClient) ListThings() ([]*Thing, error) {
+	ts := make([]*Thing, 0)
+
+	next := fmt.Sprintf("%s/things/?limit=%d", sc.base, listPageSize)
+	for next != "" {
+		var vs []*ShinyThingView
+		resp, err := sc.request(http.MethodGet, next, nil, nil, &vs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range vs {
+			t, err := ThingFromShinyView(v)
+			if err != nil {
+				log.Printf("leaving shiny thing out of the list: %s", err)
+				continue
+			}
+			ts = append(ts, t)
+		}
+
+		next, err = nextLink(resp)
+		if err != nil {
+			return nil, NewCodedError(err, http.StatusBadGateway)
+		}
+	}
+
+	return ts, nil
+}
+
+// nextLink is the absolute url of the rel="next" Link of a response, or empty
+// if it's the last page
+func nextLink(resp *http.Response) (string, error) {
+	for _, h := range resp.Header["Link"] {
+		for _, link := range strings.Split(h, ",") {
+			parts := strings.Split(link, ";")
+
+			next := false
+			for _, param := range parts[1:] {
+				if strings.TrimSpace(param) == `rel="next"` {
+					next = true
+				}
+			}
+			if !next {
+				continue
+			}
+
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				return "", errors.Errorf("malformed link %q from the shiny api", link)
+			}
+
+			u, err := url.Parse(target[1 : len(target)-1])
+			if err != nil {
+				return "", errors.Wrapf(err, "malformed link %q from the shiny api", link)
+			}
+
+			return resp.Request.URL.ResolveReference(u).String(), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (sc *ShinyClient) thing(v *ShinyThingView) (*Thing, error) {
+	t, err := ThingFromShinyView(v)
+	if err != nil {
+		return nil, NewCodedError(err, http.StatusBadGateway)
+	}
+
+	return t, nil
+}
+
+// do sends in as JSON and decodes the response into out. Error responses are
+// turned into codedErrors with the Shiny API's status code and message.
+func (sc *ShinyClient) do(method, path string, in interface{}, out interface{}) error {
+	return sc.send(method, path, nil, in, out)
+}
+
+// send is do with extra request headers
+func (sc *ShinyClient) send(method, path string, h http.Header, in interface{}, out interface{}) error {
+	_, err := sc.request(method, sc.base+path, h, in, out)
+	return err
+}
+
+// maxResponseBody is the most of a response body the ShinyClient reads
+const maxResponseBody = 1 << 20
+
+// request is send to a whole url, returning the response so its headers can be
+// read. The body has already been read and closed.
+func (sc *ShinyClient) request(method, u string, h http.Header, in interface{}, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return nil, NewCodedError(errors.Wrap(err, "shiny api unavailable"), http.StatusBadGateway)
+	}
+	defer resp.Body.Close()
+
+	// one more byte than allowed is read, so a body that's too big is an error
+	// instead of a truncated one
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > maxResponseBody {
+		return nil, NewCodedError(
+			errors.Errorf("shiny api response is bigger than %d bytes", maxResponseBody),
+			http.StatusBadGateway,
+		)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := struct {
+			Message string `json:"error-message"`
+		}{}
+
+		if json.Unmarshal(b, &e) != nil || e.Message == "" {
+			e.Message = fmt.Sprintf("shiny api said %s", resp.Status)
+		}
+
+		return nil, NewCodedError(errors.New(e.Message), resp.StatusCode)
+	}
+
+	if out == nil {
+		return resp, nil
+	}
+
+	return resp, json.Unmarshal(b, out)
+}
+
+var _ ThingService = &ShinyClient{}
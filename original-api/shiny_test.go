@@ -0,0 +1,68 @@
+package original
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestShinyClientListThingsWalksPages(t *testing.T) {
+	const total = 250
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			t.Errorf("list asked without a limit: %s", r.URL)
+			limit = total
+		}
+
+		after := -1
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			after, _ = strconv.Atoi(c)
+		}
+
+		vs := make([]*ShinyThingView, 0)
+		for id := after + 1; id < total && len(vs) < limit; id++ {
+			vs = append(vs, &ShinyThingView{
+				ID:        strconv.Itoa(id),
+				Name:      "thing",
+				Foo:       1,
+				CreatedOn: "2017-01-01T00:00:00Z",
+				UpdatedOn: "2017-01-01T00:00:00Z",
+				Version:   "0",
+			})
+		}
+
+		if len(vs) == limit {
+			w.Header().Set("Link", fmt.Sprintf(`</things/?cursor=%s&limit=%d>; rel="next"`, vs[len(vs)-1].ID, limit))
+		}
+
+		json.NewEncoder(w).Encode(vs)
+	}))
+	defer srv.Close()
+
+	ts, err := NewShinyClient(srv.URL).ListThings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts) != total {
+		t.Fatalf("got %d things, want %d", len(ts), total)
+	}
+
+	for i, th := range ts {
+		if th.ID != i {
+			t.Fatalf("thing %d has id %d", i, th.ID)
+		}
+	}
+
+	if requests != 3 {
+		t.Errorf("made %d requests, want 3", requests)
+	}
+}
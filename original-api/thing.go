@@ -1,7 +1,13 @@
-package main
+package original
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type Thing struct {
@@ -13,10 +19,65 @@ type Thing struct {
 	Version   int
 }
 
+// idempotencyWindow is how long a create's idempotency key is remembered.
+// Retrying the create with the key within it gets the Thing it made instead of
+// a second one.
+const idempotencyWindow = 24 * time.Hour
+
+// idempotencySweepEvery is how often the expired idempotency keys are dropped
+const idempotencySweepEvery = 10 * time.Minute
+
+// IdempotentCreate is what's remembered about a create with an idempotency key.
+// RequestHash tells a retry apart from a different create reusing the key.
+type IdempotentCreate struct {
+	Thing       *Thing
+	CreatedOn   time.Time
+	RequestHash string
+}
+
+// Expired says whether the create can no longer be replayed
+func (ic *IdempotentCreate) Expired() bool {
+	return time.Since(ic.CreatedOn) >= idempotencyWindow
+}
+
+// Replay is the Thing the create made, if the request with the key is the
+// same one again. Keys remembered before requests were hashed replay any
+// request.
+func (ic *IdempotentCreate) Replay(hash string) (*Thing, error) {
+	if ic.RequestHash != "" && ic.RequestHash != hash {
+		return nil, NewCodedError(
+			errors.New("the idempotency key was already used for a different create"),
+			http.StatusUnprocessableEntity,
+		)
+	}
+
+	return ic.Thing.Clone(), nil
+}
+
+// CreateRequestHash fingerprints what a create asks for
+func CreateRequestHash(name string, foo int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%q %d", name, foo)))
+	return hex.EncodeToString(sum[:])
+}
+
 type ThingService interface {
-	CreateThing(name string, foo int) (*Thing, error)
+	// CreateThing makes a Thing, or returns the one an earlier create with
+	// the same idempotency key made, if the key isn't empty. Reusing a key
+	// for a different create is a 422.
+	CreateThing(key string, name string, foo int) (*Thing, error)
 	UpdateThing(id int, version int, name string, foo int) (*Thing, error)
+	DeleteThing(id int, version int) error
 	GetThing(id int) (*Thing, error)
 	ListThings() ([]*Thing, error)
-	ThingStream() <-chan *Thing
+}
+
+func (t *Thing) Clone() *Thing {
+	return &Thing{
+		ID:        t.ID,
+		Name:      t.Name,
+		Foo:       t.Foo,
+		CreatedOn: t.CreatedOn,
+		UpdatedOn: t.UpdatedOn,
+		Version:   t.Version,
+	}
 }
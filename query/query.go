@@ -0,0 +1,593 @@
+// Package query reads the filter, sort and fields query parameters that both
+// APIs take when listing Things. Each API says which fields its Things have,
+// so the language is the same in both even though their schemas aren't.
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Query narrows, orders and trims a listing of Things. It's read from the
+// filter, sort and fields query parameters, like
+//
+//	?filter=foo>3 and name~"widget"&sort=-updated-on&fields=id,name
+//
+// A filter compares fields with =, !=, <, <=, >, >= or ~ (contains, ignoring
+// case, for text), and combines the comparisons with and, or, not and
+// parentheses. Text and times are quoted, and times are RFC 3339. The sort is
+// a list of fields, each descending when it starts with a -. The fields are
+// the ones to keep in each Thing.
+type Query struct {
+	filter filterNode
+	order  []sortKey
+	fields []string
+}
+
+type Kind int
+
+const (
+	Text Kind = iota
+	Number
+	Time
+
+	// ID is text where numeric values are ordered by their value
+	ID
+)
+
+type Value struct {
+	S string
+	N float64
+	T time.Time
+}
+
+// Field is a field of a Thing that queries can use. Get is handed the Thing
+// being matched or sorted.
+type Field struct {
+	Kind Kind
+	Get  func(thing interface{}) Value
+}
+
+// Fields are the fields queries can use, by their names in the API's schema
+type Fields map[string]*Field
+
+// LessID orders Thing ids. Numeric ids are ordered by their value, so "2"
+// comes before "10", and come before opaque ids, which are ordered lexically.
+func LessID(a, b string) bool {
+	an, bn := isNumericID(a), isNumericID(b)
+	if an != bn {
+		return an
+	}
+
+	if an {
+		ta, tb := strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(ta) != len(tb) {
+			return len(ta) < len(tb)
+		}
+		if ta != tb {
+			return ta < tb
+		}
+	}
+
+	return a < b
+}
+
+func isNumericID(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compareValues(kind Kind, a, b Value) int {
+	switch kind {
+	case Number:
+		switch {
+		case a.N < b.N:
+			return -1
+		case a.N > b.N:
+			return 1
+		}
+		return 0
+
+	case Time:
+		switch {
+		case a.T.Before(b.T):
+			return -1
+		case a.T.After(b.T):
+			return 1
+		}
+		return 0
+
+	case ID:
+		switch {
+		case LessID(a.S, b.S):
+			return -1
+		case LessID(b.S, a.S):
+			return 1
+		}
+		return 0
+
+	default:
+		return strings.Compare(a.S, b.S)
+	}
+}
+
+// Error points at the character of a query parameter that's wrong, counting
+// from 1
+type Error struct {
+	Param   string
+	Pos     int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("bad %s at position %d: %s", e.Param, e.Pos, e.Message)
+}
+
+// queryError is an Error at a byte offset of a parameter
+func queryError(param, src string, offset int, format string, args ...interface{}) error {
+	return &Error{
+		Param:   param,
+		Pos:     utf8.RuneCountInString(src[:offset]) + 1,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Parse reads the filter, sort and fields query parameters. Missing ones
+// leave the listing as it is. Malformed ones are an *Error.
+func Parse(q url.Values, fields Fields) (*Query, error) {
+	lq := &Query{}
+
+	if s := q.Get("filter"); s != "" {
+		p := &filterParser{src: s, fields: fields}
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		lq.filter, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != endToken {
+			return nil, p.errorf(p.tok.pos, "unexpected %q", p.tok.text)
+		}
+	}
+
+	if s := q.Get("sort"); s != "" {
+		err := eachListItem(s, func(item string, pos int) error {
+			k := sortKey{}
+			if strings.HasPrefix(item, "-") || strings.HasPrefix(item, "+") {
+				k.descending = item[0] == '-'
+				item, pos = item[1:], pos+1
+			}
+
+			f, exists := fields[item]
+			if !exists {
+				return queryError("sort", s, pos, "unknown field %q", item)
+			}
+			k.field = f
+
+			lq.order = append(lq.order, k)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s := q.Get("fields"); s != "" {
+		err := eachListItem(s, func(item string, pos int) error {
+			_, exists := fields[item]
+			if !exists {
+				return queryError("fields", s, pos, "unknown field %q", item)
+			}
+
+			lq.fields = append(lq.fields, item)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return lq, nil
+}
+
+// eachListItem calls f with each item of a comma separated list and the byte
+// offset it starts at
+func eachListItem(s string, f func(item string, pos int) error) error {
+	pos := 0
+	for _, item := range strings.Split(s, ",") {
+		trimmed := strings.TrimLeftFunc(item, unicode.IsSpace)
+		start := pos + len(item) - len(trimmed)
+		trimmed = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+
+		err := f(trimmed, start)
+		if err != nil {
+			return err
+		}
+
+		pos += len(item) + 1
+	}
+
+	return nil
+}
+
+// Match says whether a Thing passes the filter
+func (lq *Query) Match(thing interface{}) bool {
+	return lq.filter == nil || lq.filter.match(thing)
+}
+
+// Compare orders two Things by the sort. Things the sort can't tell apart are
+// 0, so the API can break the tie.
+func (lq *Query) Compare(a, b interface{}) int {
+	for _, k := range lq.order {
+		c := compareValues(k.field.Kind, k.field.Get(a), k.field.Get(b))
+		if k.descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// Fields are the fields to keep in each Thing, or nil to keep all of them
+func (lq *Query) Fields() []string {
+	return lq.fields
+}
+
+type sortKey struct {
+	field      *Field
+	descending bool
+}
+
+type filterNode interface {
+	match(thing interface{}) bool
+}
+
+type andNode struct{ l, r filterNode }
+
+func (n *andNode) match(thing interface{}) bool { return n.l.match(thing) && n.r.match(thing) }
+
+type orNode struct{ l, r filterNode }
+
+func (n *orNode) match(thing interface{}) bool { return n.l.match(thing) || n.r.match(thing) }
+
+type notNode struct{ n filterNode }
+
+func (n *notNode) match(thing interface{}) bool { return !n.n.match(thing) }
+
+type compareNode struct {
+	field *Field
+	op    string
+	v     Value
+}
+
+func (n *compareNode) match(thing interface{}) bool {
+	fv := n.field.Get(thing)
+
+	if n.op == "~" {
+		return strings.Contains(strings.ToLower(fv.S), strings.ToLower(n.v.S))
+	}
+
+	c := compareValues(n.field.Kind, fv, n.v)
+	switch n.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type tokenKind int
+
+const (
+	endToken tokenKind = iota
+	wordToken
+	numberToken
+	stringToken
+	opToken
+	openToken
+	closeToken
+)
+
+// token is a piece of a filter. pos is the byte offset it starts at.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// filterParser is a recursive descent parser for filters, where or binds
+// looser than and, which binds looser than not
+type filterParser struct {
+	src    string
+	fields Fields
+	pos    int
+	tok    token
+}
+
+func (p *filterParser) errorf(pos int, format string, args ...interface{}) error {
+	return queryError("filter", p.src, pos, format, args...)
+}
+
+// peek is the character at the parser's position and how many bytes it takes
+// up, or utf8.RuneError and 0 at the end of the filter
+func (p *filterParser) peek() (rune, int) {
+	if p.pos == len(p.src) {
+		return utf8.RuneError, 0
+	}
+
+	return utf8.DecodeRuneInString(p.src[p.pos:])
+}
+
+func (p *filterParser) next() error {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+
+	start := p.pos
+	if start == len(p.src) {
+		p.tok = token{kind: endToken, text: "end of filter", pos: start}
+		return nil
+	}
+
+	c, size := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		p.tok = token{kind: openToken, text: "(", pos: start}
+
+	case c == ')':
+		p.pos++
+		p.tok = token{kind: closeToken, text: ")", pos: start}
+
+	case c == '"':
+		var sb strings.Builder
+		p.pos++
+		for {
+			c, size := p.peek()
+			if size == 0 {
+				return p.errorf(start, "unterminated string")
+			}
+
+			p.pos += size
+			if c == '"' {
+				break
+			}
+			if c == '\\' && p.pos < len(p.src) {
+				c, size = p.peek()
+				p.pos += size
+			}
+			sb.WriteRune(c)
+		}
+		p.tok = token{kind: stringToken, text: sb.String(), pos: start}
+
+	case strings.ContainsRune("=!<>~", c):
+		p.pos++
+		if p.pos < len(p.src) && p.src[p.pos] == '=' && c != '~' {
+			p.pos++
+		}
+
+		op := p.src[start:p.pos]
+		switch op {
+		case "!":
+			return p.errorf(start, "expected != but found %q", op)
+		case "==":
+			op = "="
+		}
+		p.tok = token{kind: opToken, text: op, pos: start}
+
+	case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			if (p.src[p.pos] == '+' || p.src[p.pos] == '-') && p.src[p.pos-1] != 'e' && p.src[p.pos-1] != 'E' {
+				break
+			}
+			p.pos++
+		}
+		p.tok = token{kind: numberToken, text: p.src[start:p.pos], pos: start}
+
+	case c == '_' || unicode.IsLetter(c):
+		p.pos += size
+		for {
+			c, size := p.peek()
+			if size == 0 || (c != '_' && c != '-' && !unicode.IsLetter(c) && !unicode.IsDigit(c)) {
+				break
+			}
+			p.pos += size
+		}
+		p.tok = token{kind: wordToken, text: p.src[start:p.pos], pos: start}
+
+	default:
+		return p.errorf(start, "unexpected %q", string(c))
+	}
+
+	return nil
+}
+
+func (p *filterParser) keyword(k string) bool {
+	return p.tok.kind == wordToken && strings.EqualFold(p.tok.text, k)
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		err = p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		l = &orNode{l, r}
+	}
+
+	return l, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		err = p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		l = &andNode{l, r}
+	}
+
+	return l, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.keyword("not") {
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{n}, nil
+	}
+
+	if p.tok.kind == openToken {
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != closeToken {
+			return nil, p.errorf(p.tok.pos, "expected ) but found %q", p.tok.text)
+		}
+
+		return n, p.next()
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	if p.tok.kind != wordToken {
+		return nil, p.errorf(p.tok.pos, "expected a field but found %q", p.tok.text)
+	}
+
+	f, exists := p.fields[p.tok.text]
+	if !exists {
+		return nil, p.errorf(p.tok.pos, "unknown field %q", p.tok.text)
+	}
+
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != opToken {
+		return nil, p.errorf(p.tok.pos, "expected a comparison but found %q", p.tok.text)
+	}
+	op := p.tok
+
+	if op.text == "~" && f.Kind != Text {
+		return nil, p.errorf(op.pos, "~ only works on text fields")
+	}
+
+	err = p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := p.literal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compareNode{field: f, op: op.text, v: v}, p.next()
+}
+
+// literal reads the value a field is compared with
+func (p *filterParser) literal(f *Field) (Value, error) {
+	tok := p.tok
+
+	switch f.Kind {
+	case Number:
+		if tok.kind == numberToken {
+			n, err := strconv.ParseFloat(tok.text, 64)
+			if err == nil {
+				return Value{N: n}, nil
+			}
+		}
+		return Value{}, p.errorf(tok.pos, "expected a number but found %q", tok.text)
+
+	case Time:
+		if tok.kind == stringToken {
+			t, err := time.Parse(time.RFC3339Nano, tok.text)
+			if err == nil {
+				return Value{T: t}, nil
+			}
+		}
+		return Value{}, p.errorf(tok.pos, "expected a quoted RFC 3339 time but found %q", tok.text)
+
+	case ID:
+		if tok.kind == stringToken || tok.kind == numberToken {
+			return Value{S: tok.text}, nil
+		}
+		return Value{}, p.errorf(tok.pos, "expected an id but found %q", tok.text)
+
+	default:
+		if tok.kind == stringToken {
+			return Value{S: tok.text}, nil
+		}
+		return Value{}, p.errorf(tok.pos, "expected a quoted string but found %q", tok.text)
+	}
+}
@@ -0,0 +1,189 @@
+package query
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type thing struct {
+	id   string
+	name string
+	foo  float64
+	on   time.Time
+}
+
+var t0 = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var things = []*thing{
+	{"1", "widget", 1, t0},
+	{"2", "Gadget", 5, t0.Add(time.Hour)},
+	{"10", "wïdget", 10, t0.Add(2 * time.Hour)},
+	{"x", "thing", -2, t0},
+}
+
+var fields = Fields{
+	"id":         {ID, func(t interface{}) Value { return Value{S: t.(*thing).id} }},
+	"name":       {Text, func(t interface{}) Value { return Value{S: t.(*thing).name} }},
+	"foo":        {Number, func(t interface{}) Value { return Value{N: t.(*thing).foo} }},
+	"created-on": {Time, func(t interface{}) Value { return Value{T: t.(*thing).on} }},
+}
+
+func parse(param, s string) (*Query, error) {
+	return Parse(url.Values{param: []string{s}}, fields)
+}
+
+func ids(ts []*thing) string {
+	s := make([]string, len(ts))
+	for i, t := range ts {
+		s[i] = t.id
+	}
+
+	return strings.Join(s, ",")
+}
+
+func TestFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		want   string
+	}{
+		{`foo>3`, "2,10"},
+		{`foo >= 5 and name~"GET"`, "2,10"},
+		{`not (foo<0 or id="1")`, "2,10"},
+		{`id<"10"`, "1,2"},
+		{`id=10`, "10"},
+		{`name="wïdget"`, "10"},
+		{`name="wid\"get"`, ""},
+		{`created-on>"2017-01-01T00:00:00Z"`, "2,10"},
+		{`foo==1 OR foo = -2`, "1,x"},
+		{`foo=1e1`, "10"},
+		{`foo!=1 and not name~"dg"`, "x"},
+	}
+
+	for _, c := range cases {
+		q, err := parse("filter", c.filter)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.filter, err)
+			continue
+		}
+
+		var kept []*thing
+		for _, th := range things {
+			if q.Match(th) {
+				kept = append(kept, th)
+			}
+		}
+
+		if got := ids(kept); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	cases := []struct {
+		param string
+		src   string
+		pos   int
+		msg   string
+	}{
+		{"filter", `foo>`, 5, "expected a number"},
+		{"filter", `foo>"3"`, 5, "expected a number"},
+		{"filter", `bar=1`, 1, "unknown field"},
+		{"filter", `foo 3`, 5, "expected a comparison"},
+		{"filter", `foo!3`, 4, "expected !="},
+		{"filter", `name~"x`, 6, "unterminated string"},
+		{"filter", `(foo=1`, 7, "expected )"},
+		{"filter", `foo=1)`, 6, "unexpected"},
+		{"filter", `id~"1"`, 3, "~ only works on text fields"},
+		{"filter", `foo>1 and`, 10, "expected a field"},
+		{"filter", `created-on>"yesterday"`, 12, "RFC 3339"},
+		{"filter", `id=name`, 4, "expected an id"},
+		{"filter", `name=widget`, 6, "expected a quoted string"},
+
+		// positions count characters, not bytes
+		{"filter", `name="é" and bar=1`, 14, "unknown field"},
+		{"filter", `name="ok" § foo=1`, 11, `unexpected "§"`},
+		{"filter", `ñame=1`, 1, `unknown field "ñame"`},
+
+		{"sort", `foo,bar`, 5, "unknown field"},
+		{"sort", `-bar`, 2, "unknown field"},
+		{"sort", `name, ñope`, 7, "unknown field"},
+		{"fields", `id,nope`, 4, "unknown field"},
+		{"fields", "id,\u00a0nope", 5, "unknown field"},
+	}
+
+	for _, c := range cases {
+		_, err := parse(c.param, c.src)
+
+		qe, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s=%s: got %v, want a query error", c.param, c.src, err)
+			continue
+		}
+
+		if qe.Param != c.param || qe.Pos != c.pos || !strings.Contains(qe.Message, c.msg) {
+			t.Errorf("%s=%s: got %q, want %q at position %d", c.param, c.src, err, c.msg, c.pos)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	cases := []struct {
+		sort string
+		want string
+	}{
+		{`foo`, "x,1,2,10"},
+		{`-foo`, "10,2,1,x"},
+		{`+id`, "1,2,10,x"},
+		{`created-on, -foo`, "1,x,2,10"},
+		{`-name`, "10,1,x,2"},
+	}
+
+	for _, c := range cases {
+		q, err := parse("sort", c.sort)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.sort, err)
+			continue
+		}
+
+		sorted := append([]*thing(nil), things...)
+		sort.SliceStable(sorted, func(i, j int) bool { return q.Compare(sorted[i], sorted[j]) < 0 })
+
+		if got := ids(sorted); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.sort, got, c.want)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	q, err := parse("fields", " id , name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(q.Fields(), ","); got != "id,name" {
+		t.Errorf("got fields %q, want id,name", got)
+	}
+
+	q, err = Parse(url.Values{}, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Fields() != nil || !q.Match(things[0]) || q.Compare(things[0], things[1]) != 0 {
+		t.Errorf("an empty query should keep everything as it is")
+	}
+}
+
+func TestLessID(t *testing.T) {
+	ordered := []string{"0", "02", "2", "10", "99", "100", "a", "b10", "b9"}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		if !LessID(ordered[i], ordered[i+1]) || LessID(ordered[i+1], ordered[i]) {
+			t.Errorf("expected %q before %q", ordered[i], ordered[i+1])
+		}
+	}
+}
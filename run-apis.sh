@@ -4,23 +4,33 @@ set -xe
 
 original_topic=`python -c 'import time; print "things-original-{}".format(time.time()),'`
 new_topic=`python -c 'import time; print "things-new-{}".format(time.time()),'`
+command_topic=`python -c 'import time; print "thing-command-requests-{}".format(time.time()),'`
+response_topic=`python -c 'import time; print "thing-command-responses-{}".format(time.time()),'`
+control_topic=`python -c 'import time; print "thing-control-{}".format(time.time()),'`
+id_topic=`python -c 'import time; print "thing-id-leases-{}".format(time.time()),'`
+leader_topic=`python -c 'import time; print "thing-leader-{}".format(time.time()),'`
 
-go build -o original-api-api ./original-api/
-go build -o shiny-api-api ./shiny-api/
+go build -o original-api-api ./original-api/api/
+go build -o shiny-api-api ./shiny-api/api/
+go build -o shiny-api-updater ./shiny-api/updater/
 
 cleanup() {
 	killall original-api-api || true
 	killall shiny-api-api || true
+	killall shiny-api-updater || true
 
 	rm ./original-api-api
 	rm ./shiny-api-api
+	rm ./shiny-api-updater
 }
 
 trap cleanup EXIT
 
-./original-api-api -original-topic $original_topic 2>&1 | sed -e 's/^/(original-api) /' &
+./original-api-api -original-topic $original_topic -control-topic $control_topic -admin-token playground -shiny-api http://127.0.0.1:9000 2>&1 | sed -e 's/^/(original-api) /' &
 
-./shiny-api-api -new-topic $new_topic 2>&1 | sed -e 's/^/(shiny-api) /' &
+./shiny-api-updater -original-topic $original_topic -new-topic $new_topic -command-topic $command_topic -response-topic $response_topic -control-topic $control_topic -id-topic $id_topic -leader-topic $leader_topic 2>&1 | sed -e 's/^/(shiny-updater) /' &
+
+./shiny-api-api -new-topic $new_topic -command-topic $command_topic -response-topic $response_topic 2>&1 | sed -e 's/^/(shiny-api) /' &
 
 # sleep forever
 while true; do sleep 10000; done
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/apiarian/migration-playground/broker"
+	shiny "github.com/apiarian/migration-playground/shiny-api"
+)
+
+var address string
+var broker_kind string
+var brokers string
+var new_topic string
+var command_topic string
+var response_topic string
+var snapshot_dir string
+var snapshot_every time.Duration
+
+func init() {
+	flag.StringVar(
+		&address,
+		"address",
+		"127.0.0.1:9000",
+		"address and port on which to listen for HTTP requests",
+	)
+	flag.StringVar(
+		&broker_kind,
+		"broker",
+		"kafka",
+		"what carries the topics: kafka, memory to keep them in this process, or file://dir[?compact=topic,...] to keep them on disk in dir, shared with every command pointed at it, compacting the listed topics",
+	)
+	flag.StringVar(
+		&brokers,
+		"brokers",
+		"127.0.0.1:9092",
+		"addresses of the kafka brokers to talk to",
+	)
+	flag.StringVar(
+		&new_topic,
+		"new-topic",
+		fmt.Sprintf("thing-commands-%d", time.Now().Unix()),
+		"the topic for tracking things for the shiny api",
+	)
+	flag.StringVar(
+		&command_topic,
+		"command-topic",
+		fmt.Sprintf("thing-command-requests-%d", time.Now().Unix()),
+		"the topic on which commands to change things are published",
+	)
+	flag.StringVar(
+		&response_topic,
+		"response-topic",
+		fmt.Sprintf("thing-command-responses-%d", time.Now().Unix()),
+		"the topic on which the outcomes of commands are published",
+	)
+	flag.StringVar(
+		&snapshot_dir,
+		"snapshot-dir",
+		"",
+		"directory for snapshots of the thing cache, so restarts don't replay every topic; empty turns snapshots off",
+	)
+	flag.DurationVar(
+		&snapshot_every,
+		"snapshot-every",
+		time.Minute,
+		"how often to snapshot the thing cache",
+	)
+}
+
+func main() {
+	flag.Parse()
+
+	b, err := broker.Open(broker_kind, strings.Split(brokers, ","))
+	if err != nil {
+		log.Fatal("failed to open broker: ", err)
+	}
+	log.Print("using the ", broker_kind, " broker")
+
+	kc := shiny.NewKafkaClient(
+		b,
+		new_topic,
+		command_topic,
+		response_topic,
+		"",
+	)
+	defer kc.Close()
+
+	log.Print("things are on ", new_topic)
+	log.Print("commands are on ", command_topic)
+	log.Print("command responses are on ", response_topic)
+
+	var snapshots *shiny.Snapshotter
+	if snapshot_dir != "" {
+		snapshots = shiny.NewSnapshotter(snapshot_dir, "api-"+new_topic)
+		log.Printf("snapshotting things to %s every %s", snapshot_dir, snapshot_every)
+	}
+
+	ts := shiny.NewStreamThings(kc, new_topic, command_topic, response_topic, snapshots, snapshot_every)
+	sErrs := ts.Start()
+	defer ts.Stop()
+
+	history := shiny.NewHistory(kc, new_topic)
+
+	asOf := shiny.NewAsOf(kc, new_topic)
+
+	var uErrs <-chan error
+	if broker_kind == "memory" {
+		// nothing outside this process can see the topics, so the Updater
+		// has to run in here too
+		u, err := shiny.NewUpdater(kc, &shiny.UpdaterConfig{
+			NewTopic:      new_topic,
+			CommandTopic:  command_topic,
+			ResponseTopic: response_topic,
+			OwnsThings:    true,
+		})
+		if err != nil {
+			log.Fatal("failed to set up the updater: ", err)
+		}
+		uErrs = u.Start()
+		defer u.Stop()
+		log.Print("running the updater in process")
+	}
+
+	http.Handle("/", shiny.NewRouter(ts, history, asOf))
+
+	log.Print("listening on ", address)
+	s := &http.Server{
+		Addr:    address,
+		Handler: http.DefaultServeMux,
+	}
+	d := make(chan struct{})
+	go func(s *http.Server, d chan<- struct{}) {
+		log.Print("server l&s error: ", s.ListenAndServe())
+		d <- struct{}{}
+	}(s, d)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	select {
+	case <-signals:
+		log.Print("got an interrupt")
+
+	case err := <-sErrs:
+		log.Print("thing stream start error: ", err)
+
+	case err := <-uErrs:
+		log.Print("updater start error: ", err)
+	}
+
+	err = s.Shutdown(context.Background())
+	if err != nil {
+		log.Print("server shutdown error: ", err)
+	} else {
+		log.Print("server shut down cleanly")
+	}
+
+	<-d
+	log.Print("server goroutine finished")
+
+	log.Print("really done now.")
+}
@@ -0,0 +1,104 @@
+package shiny
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+// asOfTimeout is how long an as-of read waits for the next message while it
+// replays the topic
+const asOfTimeout = 10 * time.Second
+
+// AsOf answers reads as of an instant by replaying the thing topic into a
+// thing cache of its own, on each partition up to the first message published
+// after the instant. The messages are applied the way StreamThings applies
+// them, so the answer is what the stream would have served then, as far as the
+// topic has kept it.
+type AsOf struct {
+	kc    *KafkaClient
+	topic string
+}
+
+func NewAsOf(kc *KafkaClient, topic string) *AsOf {
+	return &AsOf{
+		kc:    kc,
+		topic: topic,
+	}
+}
+
+// replay builds the thing cache as it was at the instant. Only the partition
+// of id is read, unless id is empty.
+func (a *AsOf) replay(id string, at time.Time) (*StreamThings, error) {
+	marks, err := a.kc.HighWaterMarks(a.topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != "" {
+		p, err := broker.KeyPartition(a.topic, id, int32(len(marks)))
+		if err != nil {
+			return nil, err
+		}
+
+		marks = map[int32]int64{p: marks[p]}
+	}
+
+	st := &StreamThings{
+		thingCache: make(map[string]*Thing),
+		mux:        &sync.Mutex{},
+		topic:      a.topic,
+		thingFence: NewFence(),
+	}
+
+	err = broker.Replay(a.kc.b, a.topic, nil, marks, asOfTimeout, func(cm *sarama.ConsumerMessage) bool {
+		if cm.Timestamp.After(at) {
+			return false
+		}
+
+		st.applyThingMessage(cm)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// ThingAsOf is a Thing as it was at an instant
+func (a *AsOf) ThingAsOf(id string, at time.Time) (*Thing, error) {
+	st, err := a.replay(id, at)
+	if err != nil {
+		return nil, err
+	}
+
+	t, exists := st.thingCache[id]
+	if !exists {
+		return nil, NewCodedError(errors.Errorf("not found as of %s", at.Format(time.RFC3339Nano)), http.StatusNotFound)
+	}
+
+	return t, nil
+}
+
+// ThingsAsOf is every Thing that existed at an instant
+func (a *AsOf) ThingsAsOf(at time.Time) ([]*Thing, error) {
+	st, err := a.replay("", at)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := make([]*Thing, 0, len(st.thingCache))
+	for _, t := range st.thingCache {
+		ts = append(ts, t)
+	}
+
+	SortThings(ts)
+
+	return ts, nil
+}
@@ -0,0 +1,82 @@
+package shiny
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+func TestAsOfReplaysUpToTheInstant(t *testing.T) {
+	b := broker.NewMemory(broker.MemoryPartitions)
+	kc := NewKafkaClient(b, "things", "commands", "responses", "")
+
+	publish := func(th *Thing) time.Time {
+		_, err := kc.PublishThing(th, 0)
+		if err != nil {
+			t.Fatalf("failed to publish %+v: %s", th, err)
+		}
+
+		// every message gets a later timestamp than the one before
+		time.Sleep(2 * time.Millisecond)
+		return time.Now()
+	}
+
+	publish(&Thing{ID: "1", Name: "one", Version: "0"})
+	afterCreates := publish(&Thing{ID: "2", Name: "two", Version: "0"})
+	afterUpdate := publish(&Thing{ID: "1", Name: "uno", Version: "1"})
+
+	_, err := kc.PublishTombstone("2")
+	if err != nil {
+		t.Fatalf("failed to publish tombstone: %s", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	afterDelete := time.Now()
+
+	a := NewAsOf(kc, "things")
+
+	cases := []struct {
+		name  string
+		at    time.Time
+		names map[string]string
+	}{
+		{"before anything", afterCreates.Add(-time.Hour), map[string]string{}},
+		{"after the creates", afterCreates, map[string]string{"1": "one", "2": "two"}},
+		{"after the update", afterUpdate, map[string]string{"1": "uno", "2": "two"}},
+		{"after the delete", afterDelete, map[string]string{"1": "uno"}},
+	}
+
+	for _, c := range cases {
+		ts, err := a.ThingsAsOf(c.at)
+		if err != nil {
+			t.Fatalf("%s: failed to list: %s", c.name, err)
+		}
+
+		if len(ts) != len(c.names) {
+			t.Errorf("%s: got %d things, want %d", c.name, len(ts), len(c.names))
+		}
+
+		for _, th := range ts {
+			if th.Name != c.names[th.ID] {
+				t.Errorf("%s: thing %s is %q, want %q", c.name, th.ID, th.Name, c.names[th.ID])
+			}
+		}
+
+		for id, name := range c.names {
+			th, err := a.ThingAsOf(id, c.at)
+			if err != nil {
+				t.Errorf("%s: failed to get thing %s: %s", c.name, id, err)
+				continue
+			}
+
+			if th.Name != name {
+				t.Errorf("%s: thing %s is %q, want %q", c.name, id, th.Name, name)
+			}
+		}
+	}
+
+	_, err = a.ThingAsOf("2", afterDelete)
+	if CodeOrDefault(err, 0) != 404 {
+		t.Errorf("deleted thing: got %v, want a 404", err)
+	}
+}
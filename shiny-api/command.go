@@ -0,0 +1,267 @@
+package shiny
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+type CommandAction string
+
+const (
+	CreateCommand CommandAction = "create"
+	UpdateCommand CommandAction = "update"
+	DeleteCommand CommandAction = "delete"
+)
+
+type CommandStatus string
+
+const (
+	CommandPending   CommandStatus = "pending"
+	CommandSucceeded CommandStatus = "succeeded"
+	CommandFailed    CommandStatus = "failed"
+)
+
+// IdempotencyWindow is how long a create's idempotency key is remembered.
+// Retrying the create with the key within it gets the original result instead
+// of a second Thing.
+const IdempotencyWindow = 24 * time.Hour
+
+// CommandRetention is how long a command is remembered, counted from when it
+// finished, or from when it was issued while it's still pending. Older commands
+// are skipped when the topics are replayed and aren't applied any more, and
+// checking on one is a 404.
+const CommandRetention = IdempotencyWindow
+
+// sweepEvery is how often expired commands and idempotency keys are dropped
+const sweepEvery = 10 * time.Minute
+
+// CreateRequestHash fingerprints what a create asks for, so a retry can be told
+// apart from a different create reusing the idempotency key
+func CreateRequestHash(name string, foo float64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%q %v", name, foo)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Command is a request to change a Thing. Commands are published to the
+// command topic when they're issued, and their outcome is published to the
+// response topic as a CommandResult once they've been applied.
+type Command struct {
+	ID       string        `json:"id"`
+	Action   CommandAction `json:"action"`
+	ThingID  string        `json:"thing_id,omitempty"`
+	Version  string        `json:"version,omitempty"`
+	Name     string        `json:"name"`
+	Foo      float64       `json:"foo"`
+	IssuedOn time.Time     `json:"issued_on"`
+
+	// IdempotencyKey is the client's key for a create, if it sent one, and
+	// RequestHash is the CreateRequestHash of the create
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	RequestHash    string `json:"request_hash,omitempty"`
+}
+
+func NewCommandID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func NewCommand(action CommandAction) (*Command, error) {
+	id, err := NewCommandID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Command{
+		ID:       id,
+		Action:   action,
+		IssuedOn: time.Now(),
+	}, nil
+}
+
+// Expired says whether the command was issued longer than CommandRetention ago
+func (c *Command) Expired() bool {
+	return time.Since(c.IssuedOn) >= CommandRetention
+}
+
+type CommandResult struct {
+	CommandID  string        `json:"command_id"`
+	Status     CommandStatus `json:"status"`
+	Thing      *ThingEntry   `json:"thing,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Code       int           `json:"code,omitempty"`
+	FinishedOn time.Time     `json:"finished_on"`
+
+	// Token is where the change landed on the thing topic
+	Token ConsistencyToken `json:"token,omitempty"`
+
+	// IdempotencyKey is the key of the create the result is for, and
+	// RequestHash the hash of its request. Replayed is set when the result
+	// was copied from an earlier create with the key.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	RequestHash    string `json:"request_hash,omitempty"`
+	Replayed       bool   `json:"replayed,omitempty"`
+
+	// Epoch is the leader epoch the command was applied in, if an elected
+	// leader applied it
+	Epoch int64 `json:"epoch,omitempty"`
+}
+
+// Expired says whether the result is older than CommandRetention
+func (cr *CommandResult) Expired() bool {
+	return time.Since(cr.FinishedOn) >= CommandRetention
+}
+
+func ResultOfCommand(c *Command, t *Thing, tok ConsistencyToken, err error) *CommandResult {
+	cr := &CommandResult{
+		CommandID:      c.ID,
+		FinishedOn:     time.Now(),
+		IdempotencyKey: c.IdempotencyKey,
+		RequestHash:    c.RequestHash,
+	}
+
+	if err != nil {
+		cr.Status = CommandFailed
+		cr.Error = err.Error()
+		cr.Code = CodeOrDefault(err, http.StatusInternalServerError)
+		return cr
+	}
+
+	cr.Status = CommandSucceeded
+	cr.Token = tok
+	if t == nil {
+		return cr
+	}
+
+	cr.Thing = &ThingEntry{
+		ID:        t.ID,
+		Name:      t.Name,
+		Foo:       t.Foo,
+		CreatedOn: t.CreatedOn,
+		UpdatedOn: t.UpdatedOn,
+		Version:   t.Version,
+	}
+
+	return cr
+}
+
+// CommandState is what we currently know about a command
+type CommandState struct {
+	Command    *Command
+	Status     CommandStatus
+	Thing      *Thing
+	Error      string
+	Code       int
+	FinishedOn time.Time
+	Token      ConsistencyToken
+	Replayed   bool
+
+	// done is closed once the command has a result
+	done chan struct{}
+}
+
+func (cs *CommandState) Finished() bool {
+	return cs.Status == CommandSucceeded || cs.Status == CommandFailed
+}
+
+// Expired says whether the command is past CommandRetention
+func (cs *CommandState) Expired() bool {
+	if cs.Finished() {
+		return time.Since(cs.FinishedOn) >= CommandRetention
+	}
+	return cs.Command.Expired()
+}
+
+func (cs *CommandState) Clone() *CommandState {
+	x := *cs
+	if cs.Thing != nil {
+		x.Thing = cs.Thing.Clone()
+	}
+	return &x
+}
+
+// Apply folds a result into the state. Results are final, so a state that has
+// one is never sent back to pending.
+func (cs *CommandState) Apply(cr *CommandResult) {
+	finished := cs.Finished()
+
+	cs.Status = cr.Status
+	cs.Error = cr.Error
+	cs.Code = cr.Code
+	cs.FinishedOn = cr.FinishedOn
+	cs.Token = cr.Token
+	cs.Replayed = cr.Replayed
+
+	if cr.Thing != nil {
+		cs.Thing = &Thing{
+			ID:        cr.Thing.ID,
+			Name:      cr.Thing.Name,
+			Foo:       cr.Thing.Foo,
+			CreatedOn: cr.Thing.CreatedOn,
+			UpdatedOn: cr.Thing.UpdatedOn,
+			Version:   cr.Thing.Version,
+		}
+	}
+
+	if !finished {
+		close(cs.done)
+	}
+}
+
+// Outcome turns a finished command back into the return values of the
+// ThingService method it stands in for
+func (cs *CommandState) Outcome() (*Thing, error) {
+	switch cs.Status {
+	case CommandSucceeded:
+		return cs.Thing, nil
+
+	case CommandFailed:
+		return nil, NewCodedError(errors.New(cs.Error), cs.Code)
+
+	default:
+		return nil, NewCodedError(
+			errors.Errorf("command %s is still %s, see /commands/%s", cs.Command.ID, cs.Status, cs.Command.ID),
+			http.StatusGatewayTimeout,
+		)
+	}
+}
+
+func ExtractCommandFromMessage(m *sarama.ConsumerMessage) (*Command, error) {
+	var c *Command
+	err := json.Unmarshal(m.Value, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil || c.ID == "" {
+		return nil, errors.New("command has no id")
+	}
+
+	return c, nil
+}
+
+func ExtractCommandResultFromMessage(m *sarama.ConsumerMessage) (*CommandResult, error) {
+	var cr *CommandResult
+	err := json.Unmarshal(m.Value, &cr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cr == nil || cr.CommandID == "" {
+		return nil, errors.New("command result has no command id")
+	}
+
+	return cr, nil
+}
@@ -0,0 +1,85 @@
+package shiny
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConsistencyTokenHeader carries a ConsistencyToken from a write to the reads
+// that should see it
+const ConsistencyTokenHeader = "X-Consistency-Token"
+
+// consistencyTimeout is how long a read waits for the writes in its token
+const consistencyTimeout = 10 * time.Second
+
+// ConsistencyToken says how far the thing topic has to be applied for a write
+// to be visible. It has the same form as high water marks: the offset after
+// the write on each partition it touched.
+type ConsistencyToken map[int32]int64
+
+// TokenAfter is the token for a message published at partition and offset
+func TokenAfter(partition int32, offset int64) ConsistencyToken {
+	return ConsistencyToken{partition: offset + 1}
+}
+
+// String encodes the token. Clients aren't meant to look inside it.
+func (ct ConsistencyToken) String() string {
+	if len(ct) == 0 {
+		return ""
+	}
+
+	ps := make([]int, 0, len(ct))
+	for p := range ct {
+		ps = append(ps, int(p))
+	}
+	sort.Ints(ps)
+
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		parts[i] = fmt.Sprintf("%d:%d", p, ct[int32(p)])
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, ",")))
+}
+
+func ParseConsistencyToken(s string) (ConsistencyToken, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	bad := NewCodedError(errors.Errorf("bad consistency token %q", s), http.StatusBadRequest)
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, bad
+	}
+
+	ct := make(ConsistencyToken)
+	for _, part := range strings.Split(string(b), ",") {
+		po := strings.SplitN(part, ":", 2)
+		if len(po) != 2 {
+			return nil, bad
+		}
+
+		p, err := strconv.ParseInt(po[0], 10, 32)
+		if err != nil {
+			return nil, bad
+		}
+
+		o, err := strconv.ParseInt(po[1], 10, 64)
+		if err != nil {
+			return nil, bad
+		}
+
+		ct[int32(p)] = o
+	}
+
+	return ct, nil
+}
@@ -0,0 +1,100 @@
+package shiny
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	OriginalOwner = "original"
+	ShinyOwner    = "shiny"
+)
+
+// every control event shares a key so they all land on one partition, in order
+const controlKey = "mastership"
+
+const (
+	// FreezeEvent asks the old master to stop taking writes
+	FreezeEvent = "freeze"
+	// FrozenEvent is the old master saying it has stopped and published
+	// everything up to Marks on its topic
+	FrozenEvent = "frozen"
+	// OwnerEvent names the master. It finishes (or aborts) a handoff.
+	OwnerEvent = "owner"
+)
+
+// ControlEvent is a message on the control topic. The Original API reads and
+// writes the same messages.
+type ControlEvent struct {
+	Type     string          `json:"type"`
+	Handoff  string          `json:"handoff"`
+	From     string          `json:"from,omitempty"`
+	To       string          `json:"to,omitempty"`
+	Owner    string          `json:"owner,omitempty"`
+	Marks    map[int32]int64 `json:"marks,omitempty"`
+	IssuedOn time.Time       `json:"issued_on"`
+}
+
+type Handoff struct {
+	ID        string
+	From      string
+	To        string
+	Stage     string
+	Marks     map[int32]int64
+	StartedOn time.Time
+}
+
+// ControlState is what the control topic says about who owns Things
+type ControlState struct {
+	Owner   string
+	Frozen  bool
+	Handoff *Handoff
+}
+
+func (cs *ControlState) Apply(e *ControlEvent) {
+	switch e.Type {
+	case FreezeEvent:
+		cs.Frozen = true
+		cs.Handoff = &Handoff{
+			ID:        e.Handoff,
+			From:      e.From,
+			To:        e.To,
+			Stage:     FreezeEvent,
+			StartedOn: e.IssuedOn,
+		}
+
+	case FrozenEvent:
+		// compacted control topics only keep the latest event, so a frozen
+		// event has to be enough to rebuild the handoff on its own
+		if cs.Handoff == nil || cs.Handoff.ID != e.Handoff {
+			cs.Handoff = &Handoff{
+				ID:        e.Handoff,
+				From:      e.From,
+				To:        e.To,
+				StartedOn: e.IssuedOn,
+			}
+		}
+		cs.Frozen = true
+		cs.Handoff.Stage = FrozenEvent
+		cs.Handoff.Marks = e.Marks
+
+	case OwnerEvent:
+		cs.Owner = e.Owner
+		cs.Frozen = false
+		if cs.Handoff != nil && cs.Handoff.ID == e.Handoff {
+			cs.Handoff.Stage = OwnerEvent
+		}
+	}
+}
+
+func ExtractControlEventFromMessage(m *sarama.ConsumerMessage) (*ControlEvent, error) {
+	var e *ControlEvent
+	err := json.Unmarshal(m.Value, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
@@ -0,0 +1,148 @@
+package shiny
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// feedBacklog is how many changes a Feed keeps for streams that resume
+const feedBacklog = 10000
+
+// feedKeepAlive is how often an idle stream gets a comment, so proxies don't
+// close it
+const feedKeepAlive = 15 * time.Second
+
+// FeedEvent is a change read from the thing topic. Thing is nil when the Thing
+// was deleted.
+type FeedEvent struct {
+	Partition int32
+	Offset    int64
+	ID        string
+	Thing     *Thing
+}
+
+// versionID is the event id of a change in a stream of one Thing. Deletes
+// don't have one.
+func (e *FeedEvent) versionID() string {
+	if e.Thing == nil {
+		return ""
+	}
+
+	return e.Thing.Version
+}
+
+// Feed keeps the latest changes read from the thing topic for the stream
+// endpoint, along with how far each partition has been read
+type Feed struct {
+	mux      *sync.Mutex
+	backlog  []*FeedEvent
+	start    map[int32]int64
+	position map[int32]int64
+
+	// changed is closed and replaced whenever the position moves
+	changed chan struct{}
+}
+
+func NewFeed() *Feed {
+	return &Feed{
+		mux:      &sync.Mutex{},
+		start:    make(map[int32]int64),
+		position: make(map[int32]int64),
+		changed:  make(chan struct{}),
+	}
+}
+
+// Reset empties the feed, which is about to be fed from the given offsets
+func (f *Feed) Reset(from map[int32]int64) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.backlog = nil
+	f.start = make(map[int32]int64)
+	f.position = make(map[int32]int64)
+	for p, o := range from {
+		f.start[p] = o
+		f.position[p] = o
+	}
+}
+
+// Publish adds a change, dropping the oldest one once the backlog is full
+func (f *Feed) Publish(e *FeedEvent) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.backlog = append(f.backlog, e)
+	if len(f.backlog) > feedBacklog {
+		old := f.backlog[0]
+		f.backlog[0] = nil
+		f.backlog = f.backlog[1:]
+		f.start[old.Partition] = old.Offset + 1
+	}
+
+	f.advance(e.Partition, e.Offset)
+}
+
+// Skip moves past a message that didn't change anything
+func (f *Feed) Skip(partition int32, offset int64) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.advance(partition, offset)
+}
+
+// advance moves the position past a message. f.mux must be held.
+func (f *Feed) advance(partition int32, offset int64) {
+	if offset+1 > f.position[partition] {
+		f.position[partition] = offset + 1
+	}
+
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Position is where a stream starting now begins
+func (f *Feed) Position() ConsistencyToken {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.copyPosition()
+}
+
+// copyPosition copies the position. f.mux must be held.
+func (f *Feed) copyPosition() ConsistencyToken {
+	pos := make(ConsistencyToken)
+	for p, o := range f.position {
+		pos[p] = o
+	}
+
+	return pos
+}
+
+// Since returns the changes after a position, the position after them, and a
+// channel that's closed once there's more. It's a 410 when some of the changes
+// after the position have already been dropped.
+func (f *Feed) Since(after ConsistencyToken) ([]*FeedEvent, ConsistencyToken, <-chan struct{}, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for p, o := range f.start {
+		if after[p] < o {
+			return nil, nil, nil, NewCodedError(
+				errors.New("too far behind to resume, list things and stream again without Last-Event-ID"),
+				http.StatusGone,
+			)
+		}
+	}
+
+	var es []*FeedEvent
+	for _, e := range f.backlog {
+		if e.Offset >= after[e.Partition] {
+			es = append(es, e)
+		}
+	}
+
+	return es, f.copyPosition(), f.changed, nil
+}
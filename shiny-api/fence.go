@@ -0,0 +1,137 @@
+package shiny
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+// fenceKeyPrefix starts the keys of fence messages. Thing ids and command ids
+// never start with it.
+const fenceKeyPrefix = "_fence-"
+
+// fenceEntry is what a newly elected leader publishes to every partition of
+// the topics it writes, before writing anything itself
+type fenceEntry struct {
+	Epoch int64 `json:"epoch"`
+}
+
+func IsFence(m *sarama.ConsumerMessage) bool {
+	return strings.HasPrefix(string(m.Key), fenceKeyPrefix)
+}
+
+// MessageEpoch is the leader epoch a message was written in, or 0 if it wasn't
+// written by an elected leader. Tombstones can't carry one.
+func MessageEpoch(m *sarama.ConsumerMessage) int64 {
+	if IsTombstone(m) {
+		return 0
+	}
+
+	var e struct {
+		Epoch int64 `json:"epoch"`
+	}
+	if json.Unmarshal(m.Value, &e) != nil {
+		return 0
+	}
+
+	return e.Epoch
+}
+
+// fenceKeys finds a key for each of a topic's partitions
+func fenceKeys(topic string, partitions int) (map[int32]string, error) {
+	keys := make(map[int32]string)
+
+	for i := 0; len(keys) < partitions; i++ {
+		if i > 1000*partitions {
+			return nil, errors.Errorf("can't find fence keys for every partition of %s", topic)
+		}
+
+		key := fmt.Sprintf("%s%d", fenceKeyPrefix, i)
+		p, err := broker.KeyPartition(topic, key, int32(partitions))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := keys[p]; !exists {
+			keys[p] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// Fence keeps out what a replaced leader writes after its successor took
+// over. It tracks the newest epoch seen on each partition of a topic, and
+// messages from older epochs are ignored. Since a new leader fences every
+// partition before writing, anything its predecessor gets in afterwards is
+// behind the fence.
+type Fence struct {
+	mux    *sync.Mutex
+	epochs map[int32]int64
+}
+
+func NewFence() *Fence {
+	return &Fence{
+		mux:    &sync.Mutex{},
+		epochs: make(map[int32]int64),
+	}
+}
+
+// Admit reports whether a message should be applied. Fences themselves move
+// the epoch along, but aren't applied.
+func (f *Fence) Admit(m *sarama.ConsumerMessage) bool {
+	epoch := MessageEpoch(m)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if epoch != 0 && epoch < f.epochs[m.Partition] {
+		log.Printf(
+			"ignoring message %s|%d|%d:%s from epoch %d, the partition is at epoch %d",
+			m.Topic,
+			m.Partition,
+			m.Offset,
+			m.Key,
+			epoch,
+			f.epochs[m.Partition],
+		)
+		return false
+	}
+
+	if epoch > f.epochs[m.Partition] {
+		f.epochs[m.Partition] = epoch
+	}
+
+	return !IsFence(m)
+}
+
+// Epochs copies the newest epoch of each partition, for snapshots
+func (f *Fence) Epochs() map[int32]int64 {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	epochs := make(map[int32]int64)
+	for p, e := range f.epochs {
+		epochs[p] = e
+	}
+
+	return epochs
+}
+
+// Seed starts the fence off at the epochs from a snapshot
+func (f *Fence) Seed(epochs map[int32]int64) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.epochs = make(map[int32]int64)
+	for p, e := range epochs {
+		f.epochs[p] = e
+	}
+}
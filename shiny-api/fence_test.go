@@ -0,0 +1,82 @@
+package shiny
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+func TestPublishFencesCoversEveryPartition(t *testing.T) {
+	b := broker.NewMemory(broker.MemoryPartitions)
+	kc := NewKafkaClient(b, "things", "commands", "responses", "")
+
+	tok, err := kc.PublishFences("things", 7)
+	if err != nil {
+		t.Fatalf("failed to publish fences: %s", err)
+	}
+
+	if len(tok) != broker.MemoryPartitions {
+		t.Fatalf("fences went to %d partitions, want %d", len(tok), broker.MemoryPartitions)
+	}
+
+	marks, err := kc.HighWaterMarks("things")
+	if err != nil {
+		t.Fatalf("failed to get marks: %s", err)
+	}
+
+	for p, o := range marks {
+		if o != 1 {
+			t.Errorf("partition %d has %d messages, want 1", p, o)
+		}
+	}
+}
+
+func TestFenceAdmit(t *testing.T) {
+	thing := func(partition int32, epoch string) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{
+			Topic:     "things",
+			Partition: partition,
+			Key:       []byte("1"),
+			Value:     []byte(`{"id":"1","version":"0"` + epoch + `}`),
+		}
+	}
+
+	fence := &sarama.ConsumerMessage{
+		Topic:     "things",
+		Partition: 0,
+		Key:       []byte(fenceKeyPrefix + "0"),
+		Value:     []byte(`{"epoch":5}`),
+	}
+
+	tombstone := &sarama.ConsumerMessage{
+		Topic:     "things",
+		Partition: 0,
+		Key:       []byte("1"),
+	}
+
+	f := NewFence()
+
+	steps := []struct {
+		name string
+		m    *sarama.ConsumerMessage
+		want bool
+	}{
+		{"unfenced write", thing(0, ""), true},
+		{"write from epoch 3", thing(0, `,"epoch":3`), true},
+		{"fence for epoch 5", fence, false},
+		{"write from replaced epoch 3", thing(0, `,"epoch":3`), false},
+		{"write from epoch 3 on another partition", thing(1, `,"epoch":3`), true},
+		{"write from epoch 5", thing(0, `,"epoch":5`), true},
+		{"mirrored write", thing(0, ""), true},
+		{"tombstone", tombstone, true},
+	}
+
+	for _, s := range steps {
+		got := f.Admit(s.m)
+		if got != s.want {
+			t.Errorf("%s: admitted %t, want %t", s.name, got, s.want)
+		}
+	}
+}
@@ -1,11 +1,13 @@
-package main
+package shiny
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -36,12 +38,82 @@ func ViewThing(t *Thing) *ThingView {
 	}
 }
 
+// VersionView is an entry in a Thing's history. Thing is left out of the
+// entry for its deletion.
+type VersionView struct {
+	PublishedOn string     `json:"published-on"`
+	Deleted     bool       `json:"deleted,omitempty"`
+	Thing       *ThingView `json:"thing,omitempty"`
+}
+
+func ViewVersion(tv *ThingVersion) *VersionView {
+	return &VersionView{
+		PublishedOn: tv.PublishedOn.Format(time.RFC3339Nano),
+		Deleted:     tv.Thing == nil,
+		Thing:       ViewThing(tv.Thing),
+	}
+}
+
 type ThingInput struct {
 	Name    string  `json:"name"`
 	Foo     float64 `json:"foo"`
 	Version string  `json:"version"`
 }
 
+type CommandView struct {
+	ID           string     `json:"id"`
+	Action       string     `json:"action"`
+	Status       string     `json:"status"`
+	ThingID      string     `json:"thing-id,omitempty"`
+	Thing        *ThingView `json:"thing,omitempty"`
+	ErrorMessage string     `json:"error-message,omitempty"`
+	IssuedOn     string     `json:"issued-on,omitempty"`
+	FinishedOn   string     `json:"finished-on,omitempty"`
+}
+
+func ViewCommand(cs *CommandState) *CommandView {
+	if cs == nil {
+		return nil
+	}
+
+	cv := &CommandView{
+		ID:           cs.Command.ID,
+		Action:       string(cs.Command.Action),
+		Status:       string(cs.Status),
+		ThingID:      cs.Command.ThingID,
+		Thing:        ViewThing(cs.Thing),
+		ErrorMessage: cs.Error,
+	}
+
+	if !cs.Command.IssuedOn.IsZero() {
+		cv.IssuedOn = cs.Command.IssuedOn.Format(time.RFC3339)
+	}
+
+	if !cs.FinishedOn.IsZero() {
+		cv.FinishedOn = cs.FinishedOn.Format(time.RFC3339)
+	}
+
+	if cv.ThingID == "" && cs.Thing != nil {
+		cv.ThingID = cs.Thing.ID
+	}
+
+	return cv
+}
+
+// WantsAsync reports whether the client asked for the request to be handled
+// as a command with `Prefer: respond-async`
+func WantsAsync(r *http.Request) bool {
+	for _, p := range r.Header["Prefer"] {
+		for _, v := range strings.Split(p, ",") {
+			if strings.TrimSpace(v) == "respond-async" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func CodeOrDefault(err error, def int) int {
 	type coder interface {
 		Code() int
@@ -55,19 +127,103 @@ func CodeOrDefault(err error, def int) int {
 	return def
 }
 
-func MakeListThingsHandlerFunc(ts ThingService) http.HandlerFunc {
+// ParseAsOf reads the as-of query parameter, which asks for Things as they were
+// at an instant
+func ParseAsOf(r *http.Request) (time.Time, bool, error) {
+	s := r.URL.Query().Get("as-of")
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false, NewCodedError(errors.Wrap(err, "failed to parse as-of"), http.StatusBadRequest)
+	}
+
+	return at, true, nil
+}
+
+// NewRouter routes the Shiny API's endpoints to a StreamThings, the History of
+// its topic and its as-of reads
+func NewRouter(ts *StreamThings, h *History, a *AsOf) *mux.Router {
+	r := mux.NewRouter()
+
+	t := r.PathPrefix("/things").Subrouter()
+	t.HandleFunc("/", MakeListThingsHandlerFunc(ts, a)).Methods(http.MethodGet)
+	t.HandleFunc("/", MakeCreateThingHandler(ts)).Methods(http.MethodPost)
+	t.HandleFunc("/stream", MakeStreamThingsHandlerFunc(ts, ts.Feed())).Methods(http.MethodGet)
+	t.HandleFunc("/{id}", MakeGetThingHandlerFunc(ts, a)).Methods(http.MethodGet)
+	t.HandleFunc("/{id}", MakeUpdateThingHandlerFunc(ts)).Methods(http.MethodPatch)
+	t.HandleFunc("/{id}", MakeDeleteThingHandlerFunc(ts)).Methods(http.MethodDelete)
+	t.HandleFunc("/{id}/versions", MakeListVersionsHandlerFunc(h)).Methods(http.MethodGet)
+	t.HandleFunc("/{id}/versions/{version}", MakeGetVersionHandlerFunc(h)).Methods(http.MethodGet)
+
+	r.HandleFunc("/commands/{id}", MakeCheckCommandHandler(ts)).Methods(http.MethodGet)
+
+	r.HandleFunc("/healthz", MakeHealthzHandlerFunc()).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", MakeReadyzHandlerFunc(ts)).Methods(http.MethodGet)
+
+	return r
+}
+
+// MakeListThingsHandlerFunc lists Things from the ThingService, or by replaying
+// the thing topic when they're asked for as of an instant, narrowed and
+// ordered by a ListQuery, a page at a time when they're asked for with a limit
+// or a cursor
+func MakeListThingsHandlerFunc(ts ThingService, a *AsOf) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		t, err := ts.ListThings()
+		lq, err := ParseListQuery(r)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
+		page, err := ParsePage(r)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
+		at, asOf, err := ParseAsOf(r)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
+		var t []*Thing
+		if asOf {
+			t, err = a.ThingsAsOf(at)
+		} else {
+			var after ConsistencyToken
+			after, err = ParseConsistencyToken(r.Header.Get(ConsistencyTokenHeader))
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+				return
+			}
+
+			t, err = ts.ListThings(after)
+		}
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
 		}
 
-		WriteThings(w, t)
+		t, more := page.Slice(lq.Apply(t), lq.Less)
+		if more {
+			link, err := page.NextLink(r.URL, t[len(t)-1])
+			if err != nil {
+				WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			w.Header().Set("Link", link)
+		}
+
+		lq.WriteThings(w, t)
 	}
 }
 
-func MakeGetThingHandlerFunc(ts ThingService) http.HandlerFunc {
+func MakeGetThingHandlerFunc(ts ThingService, a *AsOf) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		v := mux.Vars(r)
 		id, ok := v["id"]
@@ -82,18 +238,70 @@ func MakeGetThingHandlerFunc(ts ThingService) http.HandlerFunc {
 			return
 		}
 
-		t, err := ts.GetThing(id)
+		at, asOf, err := ParseAsOf(r)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
+		if asOf {
+			t, err := a.ThingAsOf(id, at)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+				return
+			}
+
+			WriteThing(w, t)
+			return
+		}
+
+		after, err := ParseConsistencyToken(r.Header.Get(ConsistencyTokenHeader))
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
+		t, err := ts.GetThing(id, after)
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
 		}
 
+		if inm := r.Header.Get("If-None-Match"); inm != "" && MatchesETag(inm, ThingETag(t), true) {
+			WriteNotModified(w, t)
+			return
+		}
+
 		WriteThing(w, t)
 	}
 }
 
+// IdempotencyKeyHeader names a create so retrying it doesn't create again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is how long an idempotency key can be
+const maxIdempotencyKey = 255
+
+func ParseIdempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKey {
+		return "", NewCodedError(
+			errors.Errorf("%s can't be longer than %d characters", IdempotencyKeyHeader, maxIdempotencyKey),
+			http.StatusBadRequest,
+		)
+	}
+
+	return key, nil
+}
+
 func MakeCreateThingHandler(ts ThingService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := ParseIdempotencyKey(r)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+			return
+		}
+
 		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
 		if err != nil {
 			WriteError(w, http.StatusInternalServerError, err)
@@ -111,12 +319,24 @@ func MakeCreateThingHandler(ts ThingService) http.HandlerFunc {
 			return
 		}
 
-		t, err := ts.CreateThing(ti.Name, ti.Foo)
+		if WantsAsync(r) {
+			cs, err := ts.CreateThingAsync(key, ti.Name, ti.Foo)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+				return
+			}
+
+			WriteCommand(w, http.StatusAccepted, cs)
+			return
+		}
+
+		t, tok, err := ts.CreateThing(key, ti.Name, ti.Foo)
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
 		}
 
+		WriteConsistencyToken(w, tok)
 		WriteThing(w, t)
 	}
 }
@@ -153,16 +373,106 @@ func MakeUpdateThingHandlerFunc(ts ThingService) http.HandlerFunc {
 			return
 		}
 
-		t, err := ts.UpdateThing(id, ti.Version, ti.Name, ti.Foo)
+		// If-Match stands in for the version in the body. The Updater's
+		// compare-and-set checks it, and a conflict with it is a failed
+		// precondition.
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch != "" {
+			version, wildcard, err := IfMatchVersion(ifMatch)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+				return
+			}
+
+			// * only asks for the Thing to exist, so it's updated at
+			// whatever version the instance has
+			if wildcard {
+				after, err := ParseConsistencyToken(r.Header.Get(ConsistencyTokenHeader))
+				if err != nil {
+					WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+					return
+				}
+
+				current, err := ts.GetThing(id, after)
+				if CodeOrDefault(err, 0) == http.StatusNotFound {
+					WriteError(w, http.StatusPreconditionFailed, err)
+					return
+				}
+				if err != nil {
+					WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+					return
+				}
+
+				version = current.Version
+			}
+
+			if hasVersion(body) && ti.Version != version {
+				WriteError(w, http.StatusBadRequest, errors.New("the version in the body doesn't agree with If-Match"))
+				return
+			}
+
+			ti.Version = version
+		}
+
+		if WantsAsync(r) {
+			cs, err := ts.UpdateThingAsync(id, ti.Version, ti.Name, ti.Foo)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+				return
+			}
+
+			WriteCommand(w, http.StatusAccepted, cs)
+			return
+		}
+
+		t, tok, err := ts.UpdateThing(id, ti.Version, ti.Name, ti.Foo)
+		if ifMatch != "" && (CodeOrDefault(err, 0) == http.StatusConflict || CodeOrDefault(err, 0) == http.StatusNotFound) {
+			WriteError(w, http.StatusPreconditionFailed, err)
+			return
+		}
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
 		}
 
+		WriteConsistencyToken(w, tok)
 		WriteThing(w, t)
 	}
 }
 
+func MakeDeleteThingHandlerFunc(ts ThingService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		id, ok := v["id"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no id in request"))
+			return
+		}
+
+		_, err := strconv.Atoi(id)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			WriteError(w, http.StatusBadRequest, errors.New("version is required"))
+			return
+		}
+
+		tok, err := ts.DeleteThing(id, version)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteConsistencyToken(w, tok)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 func MakeCheckCommandHandler(ts ThingService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		v := mux.Vars(r)
@@ -172,13 +482,201 @@ func MakeCheckCommandHandler(ts ThingService) http.HandlerFunc {
 			return
 		}
 
-		t, err := ts.CheckCommand(cid)
+		cs, err := ts.CheckCommand(cid)
 		if err != nil {
 			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
 			return
 		}
 
-		WriteThing(w, t)
+		WriteCommand(w, http.StatusOK, cs)
+	}
+}
+
+// MakeListVersionsHandlerFunc lists the versions of a Thing from its history
+func MakeListVersionsHandlerFunc(h *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		id, ok := v["id"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no id in request"))
+			return
+		}
+
+		vs, err := h.Versions(id)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteVersions(w, vs)
+	}
+}
+
+func MakeGetVersionHandlerFunc(h *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := mux.Vars(r)
+		id, ok := v["id"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no id in request"))
+			return
+		}
+
+		version, ok := v["version"]
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("no version in request"))
+			return
+		}
+
+		tv, err := h.Version(id, version)
+		if err != nil {
+			WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		WriteThing(w, tv.Thing)
+	}
+}
+
+// MakeStreamThingsHandlerFunc streams changes to Things as server-sent events.
+// Every event's id is a ConsistencyToken for resuming with Last-Event-ID, or
+// the Thing's version when the stream is limited to one Thing with ?id=.
+func MakeStreamThingsHandlerFunc(ts ThingService, f *Feed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fl, ok := w.(http.Flusher)
+		if !ok {
+			WriteError(w, http.StatusInternalServerError, errors.New("streaming isn't supported"))
+			return
+		}
+
+		if !ts.Ready() {
+			WriteError(w, http.StatusServiceUnavailable, errors.New("still catching up with the thing topic"))
+			return
+		}
+
+		only := r.URL.Query().Get("id")
+		last := r.Header.Get("Last-Event-ID")
+
+		var pos ConsistencyToken
+		var first *FeedEvent
+		var err error
+
+		if only != "" {
+			// versions only say where a single Thing's stream is, so it
+			// picks up from the current version instead of an offset
+			pos = f.Position()
+
+			if last != "" {
+				t, err := ts.GetThing(only, nil)
+				switch {
+				case err == nil && t.Version != last:
+					first = &FeedEvent{ID: only, Thing: t}
+
+				case err != nil && CodeOrDefault(err, http.StatusInternalServerError) == http.StatusNotFound:
+					first = &FeedEvent{ID: only}
+
+				case err != nil:
+					WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+					return
+				}
+			}
+
+		} else if last != "" {
+			pos, err = ParseConsistencyToken(last)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusBadRequest), err)
+				return
+			}
+
+			_, _, _, err = f.Since(pos)
+			if err != nil {
+				WriteError(w, CodeOrDefault(err, http.StatusInternalServerError), err)
+				return
+			}
+
+		} else {
+			pos = f.Position()
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		version := last
+		if first != nil {
+			err = WriteFeedEvent(w, first.versionID(), first)
+			if err != nil {
+				return
+			}
+			version = first.versionID()
+		}
+		fl.Flush()
+
+		keepAlive := time.NewTicker(feedKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			es, next, changed, err := f.Since(pos)
+			if err != nil {
+				// the client gets the 410 when it reconnects
+				return
+			}
+
+			for _, e := range es {
+				pos[e.Partition] = e.Offset + 1
+
+				id := pos.String()
+				if only != "" {
+					if e.ID != only || (e.Thing != nil && e.Thing.Version == version) {
+						continue
+					}
+
+					id = e.versionID()
+					version = id
+				}
+
+				err = WriteFeedEvent(w, id, e)
+				if err != nil {
+					return
+				}
+			}
+
+			pos = next
+			fl.Flush()
+
+			select {
+			case <-changed:
+
+			case <-keepAlive.C:
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+				fl.Flush()
+
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// MakeHealthzHandlerFunc says the process is up, whether or not it's ready
+func MakeHealthzHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteStatus(w, http.StatusOK, "ok")
+	}
+}
+
+// MakeReadyzHandlerFunc says whether the service has caught up enough to
+// serve reads
+func MakeReadyzHandlerFunc(ts ThingService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ts.Ready() {
+			WriteStatus(w, http.StatusServiceUnavailable, "catching up")
+			return
+		}
+
+		WriteStatus(w, http.StatusOK, "ready")
 	}
 }
 
@@ -199,6 +697,7 @@ func WriteError(w http.ResponseWriter, c int, err error) {
 }
 
 func WriteThing(w http.ResponseWriter, t *Thing) {
+	w.Header().Set("ETag", ThingETag(t))
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(ViewThing(t))
 	if err != nil {
@@ -206,6 +705,74 @@ func WriteThing(w http.ResponseWriter, t *Thing) {
 	}
 }
 
+// ThingETag is the entity tag of a Thing, which is its version
+func ThingETag(t *Thing) string {
+	return fmt.Sprintf("\"%s\"", t.Version)
+}
+
+// MatchesETag says whether an If-Match or If-None-Match header lists an entity
+// tag, or is *. If-None-Match compares weakly, ignoring W/ prefixes.
+func MatchesETag(header, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IfMatchVersion is the version an If-Match header names, or a wildcard for *,
+// which only asks for the Thing to exist. A compare-and-set can only check one
+// version, and a weak tag never matches an If-Match.
+func IfMatchVersion(header string) (version string, wildcard bool, err error) {
+	tag := strings.TrimSpace(header)
+	if tag == "*" {
+		return "", true, nil
+	}
+
+	if strings.Contains(tag, ",") {
+		return "", false, NewCodedError(errors.New("If-Match can only name one version"), http.StatusBadRequest)
+	}
+
+	if strings.HasPrefix(tag, "W/") {
+		return "", false, NewCodedError(errors.New("If-Match can't match a weak entity tag"), http.StatusPreconditionFailed)
+	}
+
+	if len(tag) < 3 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return "", false, NewCodedError(errors.Errorf("bad entity tag %q in If-Match", tag), http.StatusBadRequest)
+	}
+
+	return tag[1 : len(tag)-1], false, nil
+}
+
+// WriteNotModified answers an If-None-Match that matches the Thing
+func WriteNotModified(w http.ResponseWriter, t *Thing) {
+	w.Header().Set("ETag", ThingETag(t))
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// hasVersion says whether a Thing's JSON has a version, since the zero value
+// can be a real one
+func hasVersion(body []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return false
+	}
+
+	_, exists := fields["version"]
+	return exists
+}
+
 func WriteThings(w http.ResponseWriter, ts []*Thing) {
 	tvs := make([]*ThingView, len(ts))
 	for i, t := range ts {
@@ -219,3 +786,84 @@ func WriteThings(w http.ResponseWriter, ts []*Thing) {
 		panic(err)
 	}
 }
+
+func WriteVersions(w http.ResponseWriter, vs []*ThingVersion) {
+	views := make([]*VersionView, len(vs))
+	for i, tv := range vs {
+		views[i] = ViewVersion(tv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(&views)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// WriteFeedEvent writes a change as a server-sent event. Deletes have just the
+// id of the Thing.
+func WriteFeedEvent(w io.Writer, id string, e *FeedEvent) error {
+	event := "thing"
+	var data interface{} = ViewThing(e.Thing)
+	if e.Thing == nil {
+		event = "delete"
+		data = struct {
+			ID string `json:"id"`
+		}{
+			ID: e.ID,
+		}
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		_, err = fmt.Fprintf(w, "id: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// WriteConsistencyToken lets the client read its write back from any instance
+func WriteConsistencyToken(w http.ResponseWriter, tok ConsistencyToken) {
+	if len(tok) > 0 {
+		w.Header().Set(ConsistencyTokenHeader, tok.String())
+	}
+}
+
+func WriteCommand(w http.ResponseWriter, c int, cs *CommandState) {
+	WriteConsistencyToken(w, cs.Token)
+	w.Header().Set("Content-Type", "application/json")
+	if c == http.StatusAccepted {
+		w.Header().Set("Location", "/commands/"+cs.Command.ID)
+	}
+	w.WriteHeader(c)
+
+	err := json.NewEncoder(w).Encode(ViewCommand(cs))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func WriteStatus(w http.ResponseWriter, c int, status string) {
+	s := struct {
+		Status string `json:"status"`
+	}{
+		Status: status,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(c)
+
+	err := json.NewEncoder(w).Encode(&s)
+	if err != nil {
+		panic(err)
+	}
+}
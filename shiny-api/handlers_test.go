@@ -0,0 +1,42 @@
+package shiny
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIfMatchVersion(t *testing.T) {
+	cases := []struct {
+		header   string
+		version  string
+		wildcard bool
+		code     int
+	}{
+		{`"3"`, "3", false, 0},
+		{` "12" `, "12", false, 0},
+		{`*`, "", true, 0},
+		{`"3", "4"`, "", false, http.StatusBadRequest},
+		{`W/"3"`, "", false, http.StatusPreconditionFailed},
+		{`3`, "", false, http.StatusBadRequest},
+		{`""`, "", false, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		version, wildcard, err := IfMatchVersion(c.header)
+		if c.code != 0 {
+			if CodeOrDefault(err, 0) != c.code {
+				t.Errorf("%s: got error %v, want a %d", c.header, err, c.code)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.header, err)
+			continue
+		}
+
+		if version != c.version || wildcard != c.wildcard {
+			t.Errorf("%s: got %q, %t, want %q, %t", c.header, version, wildcard, c.version, c.wildcard)
+		}
+	}
+}
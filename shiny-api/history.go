@@ -0,0 +1,98 @@
+package shiny
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/history"
+)
+
+// ThingVersion is one version of a Thing as it was published to the thing
+// topic. Thing is nil for the Thing's deletion.
+type ThingVersion struct {
+	Thing       *Thing
+	Partition   int32
+	Offset      int64
+	PublishedOn time.Time
+}
+
+// History finds every version of a Thing on the thing topic when it's asked
+// for. It reads the topic on its own, so it's complete even when the thing
+// cache starts from a snapshot, but it only has what the topic has kept.
+type History struct {
+	index *history.Index
+}
+
+func NewHistory(kc *KafkaClient, topic string) *History {
+	return &History{
+		index: history.NewIndex(kc.b, topic, history.DefaultKeys, IsFence),
+	}
+}
+
+// Versions lists a Thing's versions, oldest first, including its deletion
+func (h *History) Versions(id string) ([]*ThingVersion, error) {
+	ms, err := h.index.Messages(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fence := NewFence()
+
+	var vs []*ThingVersion
+	for _, cm := range ms {
+		if !fence.Admit(cm) {
+			continue
+		}
+
+		tv := &ThingVersion{
+			Partition:   cm.Partition,
+			Offset:      cm.Offset,
+			PublishedOn: cm.Timestamp,
+		}
+
+		if !IsTombstone(cm) {
+			tv.Thing, err = ExtractThingFromMessage(cm)
+			if err != nil {
+				log.Printf("history is skipping message %s|%d|%d: %s", cm.Topic, cm.Partition, cm.Offset, err)
+				continue
+			}
+		}
+
+		// mirroring and republishing can publish a version more than
+		// once, and it's only a new version the first time
+		if len(vs) > 0 {
+			last := vs[len(vs)-1]
+			if (last.Thing == nil && tv.Thing == nil) ||
+				(last.Thing != nil && tv.Thing != nil && last.Thing.Version == tv.Thing.Version) {
+				continue
+			}
+		}
+
+		vs = append(vs, tv)
+	}
+
+	if len(vs) == 0 {
+		return nil, NewCodedError(errors.New("not found"), http.StatusNotFound)
+	}
+
+	return vs, nil
+}
+
+// Version finds one version of a Thing
+func (h *History) Version(id, version string) (*ThingVersion, error) {
+	vs, err := h.Versions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tv := range vs {
+		if tv.Thing != nil && tv.Thing.Version == version {
+			return tv, nil
+		}
+	}
+
+	return nil, NewCodedError(errors.New("not found"), http.StatusNotFound)
+}
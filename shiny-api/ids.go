@@ -0,0 +1,214 @@
+package shiny
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// idLeaseKey keeps every lease on one partition, so all the Updaters see them
+// in the same order. Compaction only keeps the newest lease, which is enough:
+// a lease that counts ends past every one before it, and a claim that doesn't
+// count is soon followed by another from the same Updater.
+const idLeaseKey = "ids"
+
+// idLeaseAttempts is how many times a lease is claimed before giving up
+const idLeaseAttempts = 10
+
+// IDLease claims the ids from Start up to, but not including, End for one
+// Updater. A lease only counts if it starts at or after the end of every lease
+// that counted before it, so two Updaters racing for the same block can't
+// both win it.
+type IDLease struct {
+	Claim     string    `json:"claim"`
+	Owner     string    `json:"owner"`
+	Start     int       `json:"start"`
+	End       int       `json:"end"`
+	ClaimedOn time.Time `json:"claimed_on"`
+}
+
+func ExtractIDLeaseFromMessage(m *sarama.ConsumerMessage) (*IDLease, error) {
+	var l *IDLease
+	err := json.Unmarshal(m.Value, &l)
+	if err != nil {
+		return nil, err
+	}
+
+	if l == nil {
+		return nil, errors.New("empty id lease")
+	}
+
+	return l, nil
+}
+
+// IDAllocator hands out Thing ids from blocks leased on the id topic, so any
+// number of Updaters can mint ids without colliding, and ids aren't reused
+// after a restart even if the Things holding them are gone. The next block is
+// leased in the background once half of the current one is used, so minting
+// an id rarely has to wait on the id topic.
+type IDAllocator struct {
+	kc        *KafkaClient
+	topic     string
+	owner     string
+	blockSize int
+	offsets   *OffsetTracker
+
+	mux      *sync.Mutex
+	leased   int
+	accepted map[string]bool
+
+	// next and end are the part of the current lease that hasn't been handed
+	// out, and ahead gets the next lease once it's been claimed. They're only
+	// touched by Next.
+	next  int
+	end   int
+	ahead chan *leaseResult
+}
+
+// leaseResult is how a lease claimed in the background turned out
+type leaseResult struct {
+	lease *IDLease
+	err   error
+}
+
+func NewIDAllocator(
+	kc *KafkaClient,
+	topic string,
+	blockSize int,
+	offsets *OffsetTracker,
+) (*IDAllocator, error) {
+	owner, err := NewCommandID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &IDAllocator{
+		kc:        kc,
+		topic:     topic,
+		owner:     owner,
+		blockSize: blockSize,
+		offsets:   offsets,
+		mux:       &sync.Mutex{},
+		accepted:  make(map[string]bool),
+	}, nil
+}
+
+// HandleLease applies a lease read from the id topic
+func (a *IDAllocator) HandleLease(l *IDLease) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if l.Start < a.leased || l.End <= l.Start {
+		return
+	}
+
+	a.accepted[l.Claim] = true
+	a.leased = l.End
+}
+
+// Next hands out an id that's at least floor, moving on to the next block when
+// the current one runs out. It waits for that block to be leased if it hasn't
+// been yet, so it shouldn't be called while holding locks the id topic's
+// consumer needs. It isn't safe to call from more than one goroutine at a
+// time.
+func (a *IDAllocator) Next(floor int) (int, error) {
+	if a.next < floor {
+		a.next = floor
+	}
+
+	for a.next >= a.end {
+		l, err := a.nextLease(floor)
+		if err != nil {
+			return 0, err
+		}
+
+		a.next = l.Start
+		a.end = l.End
+
+		if a.next < floor {
+			a.next = floor
+		}
+	}
+
+	id := a.next
+	a.next = a.next + 1
+
+	if a.ahead == nil && a.end-a.next <= a.blockSize/2 {
+		a.ahead = make(chan *leaseResult, 1)
+
+		go func(ahead chan<- *leaseResult, floor int) {
+			l, err := a.lease(floor)
+			ahead <- &leaseResult{lease: l, err: err}
+		}(a.ahead, a.end)
+	}
+
+	return id, nil
+}
+
+// nextLease waits for the lease being claimed in the background, or claims
+// one if there isn't one
+func (a *IDAllocator) nextLease(floor int) (*IDLease, error) {
+	if a.ahead == nil {
+		return a.lease(floor)
+	}
+
+	r := <-a.ahead
+	a.ahead = nil
+
+	return r.lease, r.err
+}
+
+// lease claims the next free block that starts at or after floor, and waits to
+// read the claim back to find out whether it counted
+func (a *IDAllocator) lease(floor int) (*IDLease, error) {
+	for attempt := 0; attempt < idLeaseAttempts; attempt++ {
+		a.mux.Lock()
+		start := a.leased
+		a.mux.Unlock()
+
+		if start < floor {
+			start = floor
+		}
+
+		claim, err := NewCommandID()
+		if err != nil {
+			return nil, err
+		}
+
+		l := &IDLease{
+			Claim:     claim,
+			Owner:     a.owner,
+			Start:     start,
+			End:       start + a.blockSize,
+			ClaimedOn: time.Now(),
+		}
+
+		tok, err := a.kc.PublishIDLease(a.topic, l)
+		if err != nil {
+			return nil, err
+		}
+
+		err = a.offsets.WaitFor(a.topic, tok, consistencyTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		a.mux.Lock()
+		won := a.accepted[l.Claim]
+		a.mux.Unlock()
+
+		if won {
+			log.Printf("leased ids %d to %d", l.Start, l.End-1)
+			return l, nil
+		}
+
+		log.Printf("lost the lease on ids %d to %d to another updater", l.Start, l.End-1)
+	}
+
+	return nil, NewCodedError(errors.New("couldn't lease a block of ids"), http.StatusServiceUnavailable)
+}
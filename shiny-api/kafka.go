@@ -1,13 +1,16 @@
-package main
+package shiny
 
 import (
 	"context"
 	"encoding/json"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/broker"
 )
 
 type ThingEntry struct {
@@ -16,7 +19,11 @@ type ThingEntry struct {
 	Foo       float64   `json:"foo"`
 	CreatedOn time.Time `json:"created_on"`
 	UpdatedOn time.Time `json:"updated_on"`
-	Version   string    `json"version"`
+	Version   string    `json:"version"`
+
+	// Epoch is the leader epoch the Thing was written in, if an elected
+	// leader wrote it
+	Epoch int64 `json:"epoch,omitempty"`
 
 	encoded []byte
 	err     error
@@ -52,46 +59,34 @@ func EntryFromThing(t *Thing) (*ThingEntry, error) {
 	return te, te.err
 }
 
+// KafkaClient publishes and consumes the Shiny API's topics through a broker,
+// which is usually Kafka
 type KafkaClient struct {
-	client             sarama.Client
-	producer           sarama.SyncProducer
-	consumers          []sarama.Consumer
-	partitionConsumers []sarama.PartitionConsumer
-	new_topic          string
+	b              broker.Broker
+	new_topic      string
+	command_topic  string
+	response_topic string
+	control_topic  string
 }
 
-func NewKafkaClient(brokers []string, topic string) (*KafkaClient, error) {
-	config := sarama.NewConfig()
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Retry.Max = 10
-	config.Producer.Return.Successes = true
-
-	client, err := sarama.NewClient(brokers, config)
-	if err != nil {
-		return nil, err
-	}
-
-	producer, err := sarama.NewSyncProducerFromClient(client)
-	if err != nil {
-		client.Close()
-		return nil, err
-	}
-
+func NewKafkaClient(
+	b broker.Broker,
+	topic string,
+	command_topic string,
+	response_topic string,
+	control_topic string,
+) *KafkaClient {
 	return &KafkaClient{
-		client:             client,
-		producer:           producer,
-		consumers:          make([]sarama.Consumer, 0),
-		partitionConsumers: make([]sarama.PartitionConsumer, 0),
-		new_topic:          topic,
-	}, nil
+		b:              b,
+		new_topic:      topic,
+		command_topic:  command_topic,
+		response_topic: response_topic,
+		control_topic:  control_topic,
+	}
 }
 
 func (c *KafkaClient) Close() error {
-	for _, x := range c.consumers {
-		x.Close()
-	}
-	c.producer.Close()
-	return c.client.Close()
+	return c.b.Close()
 }
 
 func (c *KafkaClient) RegisterMessageProcessor(
@@ -100,90 +95,261 @@ func (c *KafkaClient) RegisterMessageProcessor(
 	timeout time.Duration,
 	processor chan<- *sarama.ConsumerMessage,
 ) error {
-	limit := time.Now().Add(timeout)
+	return c.b.Subscribe(ctx, topic, timeout, nil, processor)
+}
 
-SearchLoop:
-	for {
-		err := c.client.RefreshMetadata()
-		if err != nil {
-			return err
-		}
+// ResumeMessageProcessor is RegisterMessageProcessor starting at the given
+// offsets instead of the oldest
+func (c *KafkaClient) ResumeMessageProcessor(
+	ctx context.Context,
+	topic string,
+	timeout time.Duration,
+	from map[int32]int64,
+	processor chan<- *sarama.ConsumerMessage,
+) error {
+	return c.b.Subscribe(ctx, topic, timeout, from, processor)
+}
 
-		ts, err := c.client.Topics()
-		if err != nil {
-			return err
-		}
+// HighWaterMarks returns the offset of the next message to be written on each
+// of the topic's partitions
+func (c *KafkaClient) HighWaterMarks(topic string) (map[int32]int64, error) {
+	return c.b.HighWaterMarks(topic)
+}
 
-		for _, t := range ts {
-			if t == topic {
-				break SearchLoop
-			}
-		}
+// PublishThing publishes a Thing to the new topic and returns the token for
+// reading it back. The epoch is 0 unless an elected leader wrote the Thing.
+func (c *KafkaClient) PublishThing(t *Thing, epoch int64) (ConsistencyToken, error) {
+	te := &ThingEntry{
+		ID:        t.ID,
+		Name:      t.Name,
+		Foo:       t.Foo,
+		CreatedOn: t.CreatedOn,
+		UpdatedOn: t.UpdatedOn,
+		Version:   t.Version,
+		Epoch:     epoch,
+	}
 
-		if time.Now().After(limit) {
-			return errors.New("topic not found before timeout")
-		}
+	_, err := te.Encode()
+	if err != nil {
+		return nil, err
+	}
 
-		time.Sleep(500 * time.Millisecond)
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.new_topic,
+		Key:   sarama.StringEncoder(te.ID),
+		Value: te,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	cons, err := sarama.NewConsumerFromClient(c.client)
+	log.Printf("published thing %+v at %s|%d|%d", t, c.new_topic, partition, offset)
+
+	return TokenAfter(partition, offset), nil
+}
+
+func (c *KafkaClient) PublishCommand(cmd *Command) error {
+	v, err := json.Marshal(cmd)
 	if err != nil {
 		return err
 	}
 
-	c.consumers = append(c.consumers, cons)
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.command_topic,
+		Key:   sarama.StringEncoder(cmd.ID),
+		Value: sarama.ByteEncoder(v),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("published command %+v at %s|%d|%d", cmd, c.command_topic, partition, offset)
+
+	return nil
+}
+
+func (c *KafkaClient) PublishCommandResult(cr *CommandResult) error {
+	v, err := json.Marshal(cr)
+	if err != nil {
+		return err
+	}
+
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.response_topic,
+		Key:   sarama.StringEncoder(cr.CommandID),
+		Value: sarama.ByteEncoder(v),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("published command result %+v at %s|%d|%d", cr, c.response_topic, partition, offset)
+
+	return nil
+}
 
-	ps, err := cons.Partitions(topic)
+func (c *KafkaClient) PublishControlEvent(e *ControlEvent) error {
+	v, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
 
-	for _, part := range ps {
-		pcons, err := cons.ConsumePartition(topic, part, sarama.OffsetOldest)
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.control_topic,
+		Key:   sarama.StringEncoder(controlKey),
+		Value: sarama.ByteEncoder(v),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("published control event %+v at %s|%d|%d", e, c.control_topic, partition, offset)
+
+	return nil
+}
+
+// PublishIDLease publishes a claim on a block of ids. The token says where to
+// read it back.
+func (c *KafkaClient) PublishIDLease(topic string, l *IDLease) (ConsistencyToken, error) {
+	v, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(idLeaseKey),
+		Value: sarama.ByteEncoder(v),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("published id lease %+v at %s|%d|%d", l, topic, partition, offset)
+
+	return TokenAfter(partition, offset), nil
+}
+
+// PublishLeaderClaim publishes a claim on leadership. The token says where to
+// read it back.
+func (c *KafkaClient) PublishLeaderClaim(topic string, lc *LeaderClaim) (ConsistencyToken, error) {
+	v, err := json.Marshal(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(leaderKey),
+		Value: sarama.ByteEncoder(v),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return TokenAfter(partition, offset), nil
+}
+
+// PublishFences publishes a fence for the epoch to every partition of the
+// topic. The token covers all of them.
+func (c *KafkaClient) PublishFences(topic string, epoch int64) (ConsistencyToken, error) {
+	marks, err := c.b.HighWaterMarks(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := fenceKeys(topic, len(marks))
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := json.Marshal(&fenceEntry{Epoch: epoch})
+	if err != nil {
+		return nil, err
+	}
+
+	tok := make(ConsistencyToken)
+	for _, key := range keys {
+		partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.StringEncoder(key),
+			Value: sarama.ByteEncoder(v),
+		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		c.partitionConsumers = append(c.partitionConsumers, pcons)
+		log.Printf("published fence for epoch %d at %s|%d|%d", epoch, topic, partition, offset)
 
-		go func(p sarama.PartitionConsumer) {
-			for {
-				select {
-				case msg := <-p.Messages():
-					processor <- msg
+		tok[partition] = offset + 1
+	}
+
+	return tok, nil
+}
 
-				case <-ctx.Done():
-					return
-				}
-			}
-		}(pcons)
+// PublishTombstone publishes a null value for the thing's key, so compacted
+// topics eventually forget about it
+func (c *KafkaClient) PublishTombstone(id string) (ConsistencyToken, error) {
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: c.new_topic,
+		Key:   sarama.StringEncoder(id),
+		Value: nil,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	log.Printf("published tombstone for thing %s at %s|%d|%d", id, c.new_topic, partition, offset)
+
+	return TokenAfter(partition, offset), nil
 }
 
-func (c *KafkaClient) PublishThing(t *Thing) error {
-	te, err := EntryFromThing(t)
+// PublishOriginalThing publishes a Thing to a topic in the Original API's
+// format, keyed the way the Original API keys it
+func (c *KafkaClient) PublishOriginalThing(topic string, oe *OriginalThingEntry) error {
+	v, err := json.Marshal(oe)
 	if err != nil {
 		return err
 	}
 
-	partition, offset, err := c.producer.SendMessage(&sarama.ProducerMessage{
-		Topic: c.new_topic,
-		Key:   sarama.StringEncoder(te.ID),
-		Value: te,
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(strconv.Itoa(oe.ID)),
+		Value: sarama.ByteEncoder(v),
 	})
 	if err != nil {
 		return err
 	}
 
-	log.Printf("published thing %+v at %s|%d|%d", t, c.new_topic, partition, offset)
+	log.Printf("published original thing %+v at %s|%d|%d", oe, topic, partition, offset)
 
 	return nil
 }
 
+func (c *KafkaClient) PublishOriginalTombstone(topic string, id string) error {
+	partition, offset, err := c.b.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(id),
+		Value: nil,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("published original tombstone for thing %s at %s|%d|%d", id, topic, partition, offset)
+
+	return nil
+}
+
+func IsTombstone(m *sarama.ConsumerMessage) bool {
+	return m.Value == nil
+}
+
 func ExtractThingFromMessage(m *sarama.ConsumerMessage) (*Thing, error) {
+	if IsTombstone(m) {
+		return nil, errors.Errorf("message for key %s is a tombstone", m.Key)
+	}
+
 	var te *ThingEntry
 	err := json.Unmarshal(m.Value, &te)
 	if err != nil {
@@ -0,0 +1,179 @@
+package shiny
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// leaderKey keeps every claim on one partition, so all the Updaters see them
+// in the same order
+const leaderKey = "leader"
+
+// LeaderClaim asks for, or renews, the right to apply writes. Epoch is the
+// term the claim is for. From the current leader it renews the term, and from
+// anyone else it takes the term over, starting a new one whose epoch is one
+// past the claim's offset. Claims for any other term came too late and are
+// ignored. Every Updater applies the claims in the order they're on the
+// leader topic, so they all agree on who leads and in which epoch, without
+// comparing their clocks.
+type LeaderClaim struct {
+	Holder    string    `json:"holder"`
+	Epoch     int64     `json:"epoch"`
+	ClaimedOn time.Time `json:"claimed_on"`
+
+	// Offset is where the claim was read from
+	Offset int64 `json:"-"`
+}
+
+func ExtractLeaderClaimFromMessage(m *sarama.ConsumerMessage) (*LeaderClaim, error) {
+	var c *LeaderClaim
+	err := json.Unmarshal(m.Value, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, errors.New("empty leader claim")
+	}
+
+	c.Offset = m.Offset
+
+	return c, nil
+}
+
+// Leadership elects one Updater at a time to apply writes, by having every
+// Updater claim a lease on the leader topic. Leases are timed with each
+// Updater's own clock: the leader stops leading two thirds of the way into its
+// lease, counted from when it sent the claim, and everyone else waits for a
+// whole lease without hearing from it, counted from when they read the claim,
+// before taking over.
+type Leadership struct {
+	kc      *KafkaClient
+	topic   string
+	holder  string
+	ttl     time.Duration
+	offsets *OffsetTracker
+
+	mux    *sync.Mutex
+	leader string
+	epoch  int64
+
+	// heard is when the current leader's latest claim was read. renewed is
+	// when this Updater sent its latest claim that counted.
+	heard   time.Time
+	renewed time.Time
+}
+
+func NewLeadership(
+	kc *KafkaClient,
+	topic string,
+	ttl time.Duration,
+	offsets *OffsetTracker,
+) (*Leadership, error) {
+	holder, err := NewCommandID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Leadership{
+		kc:      kc,
+		topic:   topic,
+		holder:  holder,
+		ttl:     ttl,
+		offsets: offsets,
+		mux:     &sync.Mutex{},
+	}, nil
+}
+
+// HandleClaim applies a claim read from the leader topic
+func (l *Leadership) HandleClaim(c *LeaderClaim) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if c.Epoch != l.epoch {
+		return
+	}
+
+	if c.Holder != l.leader {
+		l.leader = c.Holder
+		l.epoch = c.Offset + 1
+		log.Printf("updater %s is now the leader, in epoch %d", c.Holder, l.epoch)
+	}
+
+	l.heard = time.Now()
+
+	// the claim was made with this Updater's own clock
+	if c.Holder == l.holder {
+		l.renewed = c.ClaimedOn
+	}
+}
+
+// Leading reports whether this Updater may apply writes
+func (l *Leadership) Leading() bool {
+	_, leading := l.Term()
+	return leading
+}
+
+// Term is the epoch this Updater is leading in, if it's leading. Whatever it
+// writes is stamped with the epoch, so it can be fenced off once it's been
+// replaced.
+func (l *Leadership) Term() (int64, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.leader != l.holder || time.Since(l.renewed) >= l.ttl*2/3 {
+		return 0, false
+	}
+
+	return l.epoch, true
+}
+
+// Campaign claims or renews the lease every third of its length, for as long
+// as the process runs. promoted is called whenever this Updater starts
+// leading, after the claim that made it leader has been read back.
+func (l *Leadership) Campaign(promoted func()) {
+	go func() {
+		for {
+			was := l.Leading()
+
+			err := l.claim()
+			if err != nil {
+				log.Printf("trouble claiming leadership on %s: %s", l.topic, err)
+			}
+
+			if !was && l.Leading() {
+				promoted()
+			}
+
+			time.Sleep(l.ttl / 3)
+		}
+	}()
+}
+
+// claim publishes a claim if it could count, and waits to read it back
+func (l *Leadership) claim() error {
+	l.mux.Lock()
+	c := &LeaderClaim{
+		Holder:    l.holder,
+		Epoch:     l.epoch,
+		ClaimedOn: time.Now(),
+	}
+	free := l.leader == "" || l.leader == l.holder || time.Since(l.heard) > l.ttl
+	l.mux.Unlock()
+
+	if !free {
+		return nil
+	}
+
+	tok, err := l.kc.PublishLeaderClaim(l.topic, c)
+	if err != nil {
+		return err
+	}
+
+	return l.offsets.WaitFor(l.topic, tok, consistencyTimeout)
+}
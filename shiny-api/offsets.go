@@ -0,0 +1,127 @@
+package shiny
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// OffsetTracker remembers the last offset that was applied on every partition
+// of the topics a consumer reads, so callers can wait for it to get somewhere.
+type OffsetTracker struct {
+	mux     *sync.Mutex
+	applied map[string]map[int32]int64
+	changed chan struct{}
+}
+
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{
+		mux:     &sync.Mutex{},
+		applied: make(map[string]map[int32]int64),
+		changed: make(chan struct{}),
+	}
+}
+
+// Applied records that a message has been handled. It should be called after
+// the message's effects are visible.
+func (ot *OffsetTracker) Applied(m *sarama.ConsumerMessage) {
+	ot.mux.Lock()
+	defer ot.mux.Unlock()
+
+	ot.advance(m.Topic, m.Partition, m.Offset)
+}
+
+// Seed records that everything before the given offsets has been applied,
+// for consumers that resume from a snapshot instead of reading from the start
+func (ot *OffsetTracker) Seed(topic string, next map[int32]int64) {
+	ot.mux.Lock()
+	defer ot.mux.Unlock()
+
+	for p, o := range next {
+		if o > 0 {
+			ot.advance(topic, p, o-1)
+		}
+	}
+}
+
+// advance moves a partition forward, never back. ot.mux must be held.
+func (ot *OffsetTracker) advance(topic string, partition int32, offset int64) {
+	ps, exists := ot.applied[topic]
+	if !exists {
+		ps = make(map[int32]int64)
+		ot.applied[topic] = ps
+	}
+
+	if o, exists := ps[partition]; exists && o >= offset {
+		return
+	}
+
+	ps[partition] = offset
+
+	close(ot.changed)
+	ot.changed = make(chan struct{})
+}
+
+// Next returns the offset of the next message to apply on every partition
+// that has had one applied, which is where a consumer would resume
+func (ot *OffsetTracker) Next(topic string) map[int32]int64 {
+	ot.mux.Lock()
+	defer ot.mux.Unlock()
+
+	next := make(map[int32]int64)
+	for p, o := range ot.applied[topic] {
+		next[p] = o + 1
+	}
+
+	return next
+}
+
+// Reached reports whether every partition has been applied up to, but not
+// including, the given offsets. The offsets are in the same form as high
+// water marks: the offset of the next message to be written.
+func (ot *OffsetTracker) Reached(topic string, marks map[int32]int64) bool {
+	ot.mux.Lock()
+	defer ot.mux.Unlock()
+
+	return ot.reached(topic, marks)
+}
+
+func (ot *OffsetTracker) reached(topic string, marks map[int32]int64) bool {
+	ps := ot.applied[topic]
+
+	for p, m := range marks {
+		if m <= 0 {
+			continue
+		}
+
+		o, exists := ps[p]
+		if !exists || o < m-1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WaitFor blocks until Reached would return true or the timeout expires
+func (ot *OffsetTracker) WaitFor(topic string, marks map[int32]int64, timeout time.Duration) error {
+	limit := time.After(timeout)
+
+	for {
+		ot.mux.Lock()
+		if ot.reached(topic, marks) {
+			ot.mux.Unlock()
+			return nil
+		}
+		changed := ot.changed
+		ot.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-limit:
+			return errors.Errorf("timed out waiting for %s to reach %v", topic, marks)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package shiny
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// OriginalThingView is a Thing the way the Original API's HTTP handlers show it
+type OriginalThingView struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Foo       int    `json:"foo"`
+	CreatedOn string `json:"created-on"`
+	UpdatedOn string `json:"updated-on"`
+	Version   int    `json:"version"`
+}
+
+type OriginalThingInput struct {
+	Name    string `json:"name"`
+	Foo     int    `json:"foo"`
+	Version int    `json:"version"`
+}
+
+// OriginalThingEntry is a Thing the way the Original API publishes it
+type OriginalThingEntry struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Foo       int       `json:"foo"`
+	CreatedOn time.Time `json:"created_on"`
+	UpdatedOn time.Time `json:"updated_on"`
+	Version   int       `json:"version"`
+
+	// ExactFoo is only set by the flag FooPolicy, when Foo had to be rounded
+	ExactFoo *float64 `json:"exact_foo,omitempty"`
+}
+
+// FooPolicy says what happens to a foo that isn't a whole number when a Thing
+// is published in the Original API's format
+type FooPolicy string
+
+const (
+	// RejectFoo refuses writes with such a foo
+	RejectFoo FooPolicy = "reject"
+	// RoundFoo rounds it to the nearest whole number
+	RoundFoo FooPolicy = "round"
+	// FlagFoo rounds it and keeps the exact value in exact_foo
+	FlagFoo FooPolicy = "flag"
+)
+
+func ParseFooPolicy(s string) (FooPolicy, error) {
+	switch p := FooPolicy(s); p {
+	case RejectFoo, RoundFoo, FlagFoo:
+		return p, nil
+	default:
+		return "", errors.Errorf("unknown foo policy %q", s)
+	}
+}
+
+// OriginalEntryFromThing converts a Thing into the Original API's format,
+// following the policy for a foo that isn't a whole number
+func OriginalEntryFromThing(t *Thing, policy FooPolicy) (*OriginalThingEntry, error) {
+	id, err := strconv.Atoi(t.ID)
+	if err != nil {
+		return nil, errors.Errorf("thing id %q can't be published in the original format", t.ID)
+	}
+
+	ver, err := strconv.Atoi(t.Version)
+	if err != nil {
+		return nil, errors.Errorf("thing %s version %q can't be published in the original format", t.ID, t.Version)
+	}
+
+	oe := &OriginalThingEntry{
+		ID:        id,
+		Name:      t.Name,
+		CreatedOn: t.CreatedOn,
+		UpdatedOn: t.UpdatedOn,
+		Version:   ver,
+	}
+
+	if math.IsInf(t.Foo, 0) || math.IsNaN(t.Foo) {
+		return nil, NewCodedError(errors.Errorf("foo can't be %v", t.Foo), http.StatusBadRequest)
+	}
+
+	if t.Foo == math.Trunc(t.Foo) {
+		oe.Foo = int(t.Foo)
+		return oe, nil
+	}
+
+	switch policy {
+	case RoundFoo:
+		oe.Foo = int(math.Round(t.Foo))
+
+	case FlagFoo:
+		oe.Foo = int(math.Round(t.Foo))
+		foo := t.Foo
+		oe.ExactFoo = &foo
+
+	default:
+		return nil, NewCodedError(
+			errors.Errorf("foo must be a whole number to be published for the original api, not %v", t.Foo),
+			http.StatusBadRequest,
+		)
+	}
+
+	return oe, nil
+}
+
+func ThingFromOriginalView(v *OriginalThingView) (*Thing, error) {
+	c, err := time.Parse(time.RFC3339, v.CreatedOn)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := time.Parse(time.RFC3339, v.UpdatedOn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Thing{
+		ID:        strconv.Itoa(v.ID),
+		Name:      v.Name,
+		Foo:       float64(v.Foo),
+		CreatedOn: c,
+		UpdatedOn: u,
+		Version:   strconv.Itoa(v.Version),
+	}, nil
+}
+
+func ExtractOriginalThingFromMessage(m *sarama.ConsumerMessage) (*Thing, error) {
+	if IsTombstone(m) {
+		return nil, errors.Errorf("message for key %s is a tombstone", m.Key)
+	}
+
+	var oe *OriginalThingEntry
+	err := json.Unmarshal(m.Value, &oe)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Thing{
+		ID:        strconv.Itoa(oe.ID),
+		Name:      oe.Name,
+		Foo:       float64(oe.Foo),
+		CreatedOn: oe.CreatedOn,
+		UpdatedOn: oe.UpdatedOn,
+		Version:   strconv.Itoa(oe.Version),
+	}, nil
+}
+
+// OriginalFoo converts a foo to the Original API's whole numbers, refusing
+// anything that would lose information on the way
+func OriginalFoo(foo float64) (int, error) {
+	if foo != math.Trunc(foo) || math.IsInf(foo, 0) || math.IsNaN(foo) {
+		return 0, NewCodedError(
+			errors.Errorf("foo must be a whole number while the original api owns things, not %v", foo),
+			http.StatusBadRequest,
+		)
+	}
+
+	return int(foo), nil
+}
+
+func originalNumber(field, s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, NewCodedError(
+			errors.Errorf("%s must be numeric while the original api owns things, not %q", field, s),
+			http.StatusBadRequest,
+		)
+	}
+
+	return i, nil
+}
+
+// OriginalClient talks to the Original API over HTTP
+type OriginalClient struct {
+	base   string
+	client *http.Client
+}
+
+func NewOriginalClient(base string) *OriginalClient {
+	return &OriginalClient{
+		base: base,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (oc *OriginalClient) CreateThing(key, name string, foo float64) (*Thing, error) {
+	f, err := OriginalFoo(foo)
+	if err != nil {
+		return nil, err
+	}
+
+	h := make(http.Header)
+	if key != "" {
+		h.Set(IdempotencyKeyHeader, key)
+	}
+
+	var v *OriginalThingView
+	err = oc.send(http.MethodPost, "/things/", h, &OriginalThingInput{Name: name, Foo: f}, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return ThingFromOriginalView(v)
+}
+
+func (oc *OriginalClient) UpdateThing(id, version, name string, foo float64) (*Thing, error) {
+	i, err := originalNumber("id", id)
+	if err != nil {
+		return nil, err
+	}
+
+	ver, err := originalNumber("version", version)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := OriginalFoo(foo)
+	if err != nil {
+		return nil, err
+	}
+
+	var v *OriginalThingView
+	err = oc.do(
+		http.MethodPost,
+		fmt.Sprintf("/things/%d", i),
+		&OriginalThingInput{Name: name, Foo: f, Version: ver},
+		&v,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return ThingFromOriginalView(v)
+}
+
+func (oc *OriginalClient) DeleteThing(id, version string) error {
+	i, err := originalNumber("id", id)
+	if err != nil {
+		return err
+	}
+
+	ver, err := originalNumber("version", version)
+	if err != nil {
+		return err
+	}
+
+	return oc.do(http.MethodDelete, fmt.Sprintf("/things/%d?version=%d", i, ver), nil, nil)
+}
+
+// do sends in as JSON and decodes the response into out. Error responses are
+// turned into codedErrors with the Original API's status code and message.
+func (oc *OriginalClient) do(method, path string, in interface{}, out interface{}) error {
+	return oc.send(method, path, nil, in, out)
+}
+
+// send is do with extra request headers
+func (oc *OriginalClient) send(method, path string, h http.Header, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, oc.base+path, body)
+	if err != nil {
+		return err
+	}
+
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := oc.client.Do(req)
+	if err != nil {
+		return NewCodedError(errors.Wrap(err, "original api unavailable"), http.StatusBadGateway)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := struct {
+			Message string `json:"error-message"`
+		}{}
+
+		if json.Unmarshal(b, &e) != nil || e.Message == "" {
+			e.Message = fmt.Sprintf("original api said %s", resp.Status)
+		}
+
+		return NewCodedError(errors.New(e.Message), resp.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,124 @@
+package shiny
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/apiarian/migration-playground/query"
+)
+
+// defaultPageLimit is how many Things a page has when it's asked for with a
+// cursor but no limit
+const defaultPageLimit = 100
+
+// maxPageLimit is the most Things a page can have
+const maxPageLimit = 1000
+
+// SortThings sorts Things by id, in the order pages walk them
+func SortThings(ts []*Thing) {
+	sort.Slice(ts, func(i, j int) bool { return query.LessID(ts[i].ID, ts[j].ID) })
+}
+
+// Page is a slice of a listing of Things. It picks up after the Thing in its
+// cursor rather than at an index, so Things created or deleted while a client
+// walks the pages don't shift the rest of them. The cursor keeps all of the
+// Thing's fields, so it works whichever of them the listing is sorted by.
+type Page struct {
+	After *Thing
+	Limit int
+}
+
+// ParsePage reads the limit and cursor query parameters. Without either of
+// them the whole listing is one page.
+func ParsePage(r *http.Request) (*Page, error) {
+	q := r.URL.Query()
+
+	l, c := q.Get("limit"), q.Get("cursor")
+	if l == "" && c == "" {
+		return nil, nil
+	}
+
+	p := &Page{Limit: defaultPageLimit}
+
+	if l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return nil, NewCodedError(
+				errors.Errorf("limit must be a number from 1 to %d", maxPageLimit),
+				http.StatusBadRequest,
+			)
+		}
+
+		p.Limit = n
+	}
+
+	if c != "" {
+		bad := NewCodedError(errors.Errorf("bad cursor %q", c), http.StatusBadRequest)
+
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			return nil, bad
+		}
+
+		var te ThingEntry
+		err = json.Unmarshal(b, &te)
+		if err != nil || te.ID == "" {
+			return nil, bad
+		}
+
+		p.After = &Thing{
+			ID:        te.ID,
+			Name:      te.Name,
+			Foo:       te.Foo,
+			CreatedOn: te.CreatedOn,
+			UpdatedOn: te.UpdatedOn,
+			Version:   te.Version,
+		}
+	}
+
+	return p, nil
+}
+
+// Slice picks the page out of Things sorted by less, and says whether there
+// are more after it
+func (p *Page) Slice(ts []*Thing, less func(a, b *Thing) bool) ([]*Thing, bool) {
+	if p == nil {
+		return ts, false
+	}
+
+	start := 0
+	if p.After != nil {
+		start = sort.Search(len(ts), func(i int) bool { return less(p.After, ts[i]) })
+	}
+	ts = ts[start:]
+
+	if len(ts) > p.Limit {
+		return ts[:p.Limit], true
+	}
+
+	return ts, false
+}
+
+// NextLink is the link to the page after the one ending with the given Thing,
+// keeping the rest of the request's query
+func (p *Page) NextLink(u *url.URL, last *Thing) (string, error) {
+	te, err := EntryFromThing(last)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("cursor", base64.RawURLEncoding.EncodeToString(te.encoded))
+	q.Set("limit", strconv.Itoa(p.Limit))
+
+	next := url.URL{Path: u.Path, RawQuery: q.Encode()}
+
+	return fmt.Sprintf("<%s>; rel=\"next\"", next.String()), nil
+}
@@ -0,0 +1,100 @@
+package shiny
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/apiarian/migration-playground/query"
+)
+
+// ListQuery narrows, orders and trims a listing of Things, as a query.Query
+// over the fields of a ThingView. Ties in the sort are broken by id.
+type ListQuery struct {
+	q *query.Query
+}
+
+func thingField(kind query.Kind, get func(t *Thing) query.Value) *query.Field {
+	return &query.Field{
+		Kind: kind,
+		Get:  func(thing interface{}) query.Value { return get(thing.(*Thing)) },
+	}
+}
+
+var thingFields = query.Fields{
+	"id":         thingField(query.ID, func(t *Thing) query.Value { return query.Value{S: t.ID} }),
+	"name":       thingField(query.Text, func(t *Thing) query.Value { return query.Value{S: t.Name} }),
+	"foo":        thingField(query.Number, func(t *Thing) query.Value { return query.Value{N: t.Foo} }),
+	"created-on": thingField(query.Time, func(t *Thing) query.Value { return query.Value{T: t.CreatedOn} }),
+	"updated-on": thingField(query.Time, func(t *Thing) query.Value { return query.Value{T: t.UpdatedOn} }),
+	"version":    thingField(query.ID, func(t *Thing) query.Value { return query.Value{S: t.Version} }),
+}
+
+// ParseListQuery reads the filter, sort and fields query parameters. A
+// malformed one is a 400 saying at which character it went wrong.
+func ParseListQuery(r *http.Request) (*ListQuery, error) {
+	q, err := query.Parse(r.URL.Query(), thingFields)
+	if err != nil {
+		return nil, NewCodedError(err, http.StatusBadRequest)
+	}
+
+	return &ListQuery{q: q}, nil
+}
+
+// Apply filters Things and sorts what's left
+func (lq *ListQuery) Apply(ts []*Thing) []*Thing {
+	kept := make([]*Thing, 0, len(ts))
+	for _, t := range ts {
+		if lq.q.Match(t) {
+			kept = append(kept, t)
+		}
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool { return lq.Less(kept[i], kept[j]) })
+
+	return kept
+}
+
+// Less is the order of the listing: the sort, then the id
+func (lq *ListQuery) Less(a, b *Thing) bool {
+	if c := lq.q.Compare(a, b); c != 0 {
+		return c < 0
+	}
+
+	return query.LessID(a.ID, b.ID)
+}
+
+// WriteThings writes Things with only the fields that were asked for
+func (lq *ListQuery) WriteThings(w http.ResponseWriter, ts []*Thing) {
+	fields := lq.q.Fields()
+	if fields == nil {
+		WriteThings(w, ts)
+		return
+	}
+
+	vs := make([]map[string]json.RawMessage, len(ts))
+	for i, t := range ts {
+		b, err := json.Marshal(ViewThing(t))
+		if err != nil {
+			panic(err)
+		}
+
+		var all map[string]json.RawMessage
+		err = json.Unmarshal(b, &all)
+		if err != nil {
+			panic(err)
+		}
+
+		vs[i] = make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			vs[i][f] = all[f]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(&vs)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,237 @@
+package shiny
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotsKept is how many snapshots are left on disk, in case the newest
+// turns out to be unreadable
+const snapshotsKept = 3
+
+// Snapshot is a copy of a thing cache along with the offsets of every topic
+// it reflects, so a consumer can pick up from there instead of replaying the
+// topics from the start
+type Snapshot struct {
+	Offsets map[string]map[int32]int64 `json:"offsets"`
+	Things  []*ThingEntry              `json:"things"`
+	NextID  int                        `json:"next_id,omitempty"`
+
+	// Deleted has the version each deleted Thing was deleted at, for caches
+	// that need to tell its old versions apart from new ones
+	Deleted map[string]string `json:"deleted,omitempty"`
+
+	// Epochs is the newest leader epoch seen on each partition of the thing
+	// topic, so writes from replaced leaders are still fenced off after
+	// resuming
+	Epochs  map[int32]int64 `json:"epochs,omitempty"`
+	TakenOn time.Time       `json:"taken_on"`
+}
+
+// snapshotFile is what's written to disk. The checksum catches snapshots that
+// were cut short or damaged.
+type snapshotFile struct {
+	Checksum string          `json:"checksum"`
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+func (s *Snapshot) Cache() map[string]*Thing {
+	cache := make(map[string]*Thing)
+	for _, te := range s.Things {
+		cache[te.ID] = &Thing{
+			ID:        te.ID,
+			Name:      te.Name,
+			Foo:       te.Foo,
+			CreatedOn: te.CreatedOn,
+			UpdatedOn: te.UpdatedOn,
+			Version:   te.Version,
+		}
+	}
+
+	return cache
+}
+
+func NewSnapshot(cache map[string]*Thing) *Snapshot {
+	s := &Snapshot{
+		Offsets: make(map[string]map[int32]int64),
+		Deleted: make(map[string]string),
+		Things:  make([]*ThingEntry, 0, len(cache)),
+		TakenOn: time.Now(),
+	}
+
+	for _, t := range cache {
+		s.Things = append(s.Things, &ThingEntry{
+			ID:        t.ID,
+			Name:      t.Name,
+			Foo:       t.Foo,
+			CreatedOn: t.CreatedOn,
+			UpdatedOn: t.UpdatedOn,
+			Version:   t.Version,
+		})
+	}
+
+	return s
+}
+
+// Snapshotter keeps the snapshots of one cache in a directory
+type Snapshotter struct {
+	dir  string
+	name string
+}
+
+// NewSnapshotter keeps snapshots in dir. The name tells apart the caches
+// sharing the directory, so it should include the topics they're built from.
+func NewSnapshotter(dir string, name string) *Snapshotter {
+	return &Snapshotter{
+		dir:  dir,
+		name: name,
+	}
+}
+
+// Save writes a snapshot next to the older ones and clears out the oldest
+func (sn *Snapshotter) Save(s *Snapshot) error {
+	err := os.MkdirAll(sn.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(b)
+
+	f, err := json.Marshal(&snapshotFile{
+		Checksum: hex.EncodeToString(sum[:]),
+		Snapshot: b,
+	})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(sn.dir, fmt.Sprintf("%s-%020d.json", sn.name, s.TakenOn.UnixNano()))
+
+	// renaming makes the snapshot show up all at once
+	err = ioutil.WriteFile(path+".tmp", f, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	paths, err := sn.paths()
+	if err != nil {
+		return err
+	}
+
+	for i := snapshotsKept; i < len(paths); i++ {
+		os.Remove(paths[i])
+	}
+
+	return nil
+}
+
+// Every saves a snapshot from take on every tick, for as long as the process
+// runs
+func (sn *Snapshotter) Every(every time.Duration, take func() *Snapshot) {
+	go func() {
+		for range time.Tick(every) {
+			err := sn.Save(take())
+			if err != nil {
+				log.Printf("trouble saving %s snapshot: %s", sn.name, err)
+			}
+		}
+	}()
+}
+
+// Load returns the newest snapshot that can be read, or nil if there isn't
+// one
+func (sn *Snapshotter) Load() (*Snapshot, error) {
+	paths, err := sn.paths()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, path := range paths {
+		s, err := readSnapshot(path)
+		if err != nil {
+			log.Printf("skipping snapshot %s: %s", path, err)
+			continue
+		}
+
+		return s, nil
+	}
+
+	return nil, nil
+}
+
+// paths lists the snapshots, newest first
+func (sn *Snapshotter) paths() ([]string, error) {
+	fis, err := ioutil.ReadDir(sn.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, fi := range fis {
+		// the length check keeps a name that's a prefix of another name from
+		// picking up its snapshots
+		n := fi.Name()
+		if strings.HasPrefix(n, sn.name+"-") && strings.HasSuffix(n, ".json") && len(n) == len(sn.name)+26 {
+			paths = append(paths, filepath.Join(sn.dir, n))
+		}
+	}
+
+	// the timestamps are zero padded, so names sort by age
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	return paths, nil
+}
+
+func readSnapshot(path string) (*Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f snapshotFile
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(f.Snapshot)
+	if hex.EncodeToString(sum[:]) != f.Checksum {
+		return nil, errors.New("checksum doesn't match")
+	}
+
+	var s *Snapshot
+	err = json.Unmarshal(f.Snapshot, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	if s == nil || s.Offsets == nil {
+		return nil, errors.New("snapshot has no offsets")
+	}
+
+	return s, nil
+}
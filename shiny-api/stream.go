@@ -1,10 +1,9 @@
-package main
+package shiny
 
 import (
 	"context"
 	"log"
 	"net/http"
-	"sort"
 	"sync"
 	"time"
 
@@ -13,20 +12,59 @@ import (
 )
 
 type StreamThings struct {
-	kc         *KafkaClient
-	u          *Updater
-	thingCache map[string]*Thing
-	mux        *sync.Mutex
-	topic      string
+	kc            *KafkaClient
+	thingCache    map[string]*Thing
+	commands      map[string]*CommandState
+	mux           *sync.Mutex
+	topic         string
+	commandTopic  string
+	responseTopic string
+	offsets       *OffsetTracker
+	feed          *Feed
+
+	// thingFence and resultFence keep out writes from Updaters that were
+	// no longer leading
+	thingFence  *Fence
+	resultFence *Fence
+
+	// ready is closed once the thing and response topics have been read up
+	// to where they were at startup
+	ready      chan struct{}
+	catchingUp int
+
+	// done is closed when the stream is stopped
+	done chan struct{}
+
+	// snapshots is nil when the cache isn't snapshotted
+	snapshots     *Snapshotter
+	snapshotEvery time.Duration
 }
 
-func NewStreamThings(kc *KafkaClient, u *Updater, topic string) *StreamThings {
+func NewStreamThings(
+	kc *KafkaClient,
+	topic string,
+	commandTopic string,
+	responseTopic string,
+	snapshots *Snapshotter,
+	snapshotEvery time.Duration,
+) *StreamThings {
 	return &StreamThings{
-		kc:         kc,
-		thingCache: make(map[string]*Thing),
-		mux:        &sync.Mutex{},
-		u:          u,
-		topic:      topic,
+		kc:            kc,
+		thingCache:    make(map[string]*Thing),
+		commands:      make(map[string]*CommandState),
+		mux:           &sync.Mutex{},
+		topic:         topic,
+		commandTopic:  commandTopic,
+		responseTopic: responseTopic,
+		offsets:       NewOffsetTracker(),
+		feed:          NewFeed(),
+		thingFence:    NewFence(),
+		resultFence:   NewFence(),
+		ready:         make(chan struct{}),
+		catchingUp:    2,
+		done:          make(chan struct{}),
+		snapshots:     snapshots,
+		snapshotEvery: snapshotEvery,
 	}
 }
 
@@ -37,10 +75,39 @@ func (st *StreamThings) Start() <-chan error {
 
 	go func(c <-chan *sarama.ConsumerMessage) {
 		for cm := range c {
-			t, err := ExtractThingFromMessage(cm)
+			st.handleThingMessage(cm)
+			st.offsets.Applied(cm)
+		}
+	}(messages)
+
+	go func() {
+		err := st.registerThingProcessor(messages)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		log.Printf("stream message processor registered")
+
+		err = st.catchUp(st.topic)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		if st.snapshots != nil {
+			st.snapshots.Every(st.snapshotEvery, st.snapshot)
+		}
+	}()
+
+	commands := make(chan *sarama.ConsumerMessage)
+
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for cm := range c {
+			cmd, err := ExtractCommandFromMessage(cm)
 			if err != nil {
 				log.Printf(
-					"trouble with message %s|%d|%d:%s (%s): %s: %v",
+					"trouble with command message %s|%d|%d:%s (%s): %s: %v",
 					cm.Topic,
 					cm.Partition,
 					cm.Offset,
@@ -52,31 +119,288 @@ func (st *StreamThings) Start() <-chan error {
 				continue
 			}
 
-			err = st.HandleThingFromMessage(t)
+			st.HandleCommandFromMessage(cmd)
+		}
+	}(commands)
+
+	go func() {
+		err := st.kc.RegisterMessageProcessor(
+			context.Background(),
+			st.commandTopic,
+			5*time.Minute,
+			commands,
+		)
+
+		if err != nil {
+			errs <- err
+		} else {
+			log.Printf("command message processor registered")
+		}
+	}()
+
+	results := make(chan *sarama.ConsumerMessage)
+
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for cm := range c {
+			if !st.resultFence.Admit(cm) {
+				st.offsets.Applied(cm)
+				continue
+			}
+
+			cr, err := ExtractCommandResultFromMessage(cm)
 			if err != nil {
-				log.Printf("error handling thing %+v: %s", t, err)
+				log.Printf(
+					"trouble with command result message %s|%d|%d:%s (%s): %s: %v",
+					cm.Topic,
+					cm.Partition,
+					cm.Offset,
+					cm.Key,
+					cm.Timestamp,
+					cm.Value,
+					err,
+				)
+			} else {
+				st.HandleCommandResultFromMessage(cr)
 			}
+
+			st.offsets.Applied(cm)
 		}
-	}(messages)
+	}(results)
+
+	go st.sweep(sweepEvery)
 
 	go func() {
 		err := st.kc.RegisterMessageProcessor(
 			context.Background(),
-			st.topic,
+			st.responseTopic,
 			5*time.Minute,
-			messages,
+			results,
 		)
 
 		if err != nil {
 			errs <- err
-		} else {
-			log.Printf("stream message processor registered")
+			return
+		}
+
+		log.Printf("command result message processor registered")
+
+		err = st.catchUp(st.responseTopic)
+		if err != nil {
+			errs <- err
 		}
 	}()
 
 	return errs
 }
 
+// Stop ends the stream's periodic work. Its topics stop being read when the
+// broker is closed.
+func (st *StreamThings) Stop() {
+	close(st.done)
+}
+
+// sweep drops expired commands every so often until the stream is stopped
+func (st *StreamThings) sweep(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-st.done:
+			return
+
+		case <-ticker.C:
+			st.mux.Lock()
+			for id, cs := range st.commands {
+				if cs.Expired() {
+					delete(st.commands, id)
+				}
+			}
+			st.mux.Unlock()
+		}
+	}
+}
+
+// registerThingProcessor starts reading the thing topic where the newest
+// snapshot left off, or from the start if there isn't a snapshot it can use
+func (st *StreamThings) registerThingProcessor(messages chan<- *sarama.ConsumerMessage) error {
+	if st.snapshots != nil {
+		s, err := st.snapshots.Load()
+		if err != nil {
+			log.Printf("trouble loading snapshot: %s", err)
+		}
+
+		if s != nil {
+			st.mux.Lock()
+			st.thingCache = s.Cache()
+			st.mux.Unlock()
+
+			st.thingFence.Seed(s.Epochs)
+
+			from := s.Offsets[st.topic]
+			st.feed.Reset(from)
+
+			err = st.kc.ResumeMessageProcessor(
+				context.Background(),
+				st.topic,
+				5*time.Minute,
+				from,
+				messages,
+			)
+			if err == nil {
+				st.offsets.Seed(st.topic, from)
+				log.Printf("resumed %s from the snapshot taken on %s", st.topic, s.TakenOn)
+				return nil
+			}
+
+			log.Printf("can't resume %s from the snapshot, reading it from the start: %s", st.topic, err)
+
+			st.mux.Lock()
+			st.thingCache = make(map[string]*Thing)
+			st.mux.Unlock()
+
+			st.thingFence.Seed(nil)
+			st.feed.Reset(nil)
+		}
+	}
+
+	return st.kc.RegisterMessageProcessor(
+		context.Background(),
+		st.topic,
+		5*time.Minute,
+		messages,
+	)
+}
+
+// snapshot copies the cache along with how far the thing topic has been
+// applied. The offsets are read first, so the cache is never behind them, and
+// the epochs before that, so they're never ahead.
+func (st *StreamThings) snapshot() *Snapshot {
+	epochs := st.thingFence.Epochs()
+	next := st.offsets.Next(st.topic)
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	s := NewSnapshot(st.thingCache)
+	s.Offsets[st.topic] = next
+	s.Epochs = epochs
+
+	return s
+}
+
+// catchUp waits until the topic has been read as far as it went when it was
+// asked, and marks the stream ready once every topic has
+func (st *StreamThings) catchUp(topic string) error {
+	marks, err := st.kc.HighWaterMarks(topic)
+	if err != nil {
+		return err
+	}
+
+	err = st.offsets.WaitFor(topic, marks, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	log.Printf("caught up with %s", topic)
+
+	st.catchingUp--
+	if st.catchingUp == 0 {
+		close(st.ready)
+		log.Printf("ready to serve reads")
+	}
+
+	return nil
+}
+
+// Ready reports whether the stream has caught up, so its reads aren't missing
+// Things that exist
+func (st *StreamThings) Ready() bool {
+	select {
+	case <-st.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (st *StreamThings) checkReady() error {
+	if !st.Ready() {
+		return NewCodedError(errors.New("still catching up with the thing topic"), http.StatusServiceUnavailable)
+	}
+
+	return nil
+}
+
+// Feed is the changes the stream has read, for streaming them to clients
+func (st *StreamThings) Feed() *Feed {
+	return st.feed
+}
+
+func (st *StreamThings) handleThingMessage(cm *sarama.ConsumerMessage) {
+	e := st.applyThingMessage(cm)
+	if e == nil {
+		st.feed.Skip(cm.Partition, cm.Offset)
+		return
+	}
+
+	st.feed.Publish(e)
+}
+
+// applyThingMessage applies a message from the thing topic to the cache. It
+// returns the change for the feed, or nil if the message didn't change
+// anything.
+func (st *StreamThings) applyThingMessage(cm *sarama.ConsumerMessage) *FeedEvent {
+	if !st.thingFence.Admit(cm) {
+		return nil
+	}
+
+	if IsTombstone(cm) {
+		err := st.HandleTombstone(string(cm.Key))
+		if err != nil {
+			log.Printf("error handling tombstone for %s: %s", cm.Key, err)
+			return nil
+		}
+
+		return &FeedEvent{
+			Partition: cm.Partition,
+			Offset:    cm.Offset,
+			ID:        string(cm.Key),
+		}
+	}
+
+	t, err := ExtractThingFromMessage(cm)
+	if err != nil {
+		log.Printf(
+			"trouble with message %s|%d|%d:%s (%s): %s: %v",
+			cm.Topic,
+			cm.Partition,
+			cm.Offset,
+			cm.Key,
+			cm.Timestamp,
+			cm.Value,
+			err,
+		)
+		return nil
+	}
+
+	err = st.HandleThingFromMessage(t)
+	if err != nil {
+		log.Printf("error handling thing %+v: %s", t, err)
+		return nil
+	}
+
+	return &FeedEvent{
+		Partition: cm.Partition,
+		Offset:    cm.Offset,
+		ID:        t.ID,
+		Thing:     t.Clone(),
+	}
+}
+
 func (st *StreamThings) HandleThingFromMessage(t *Thing) error {
 	st.mux.Lock()
 	defer st.mux.Unlock()
@@ -86,6 +410,15 @@ func (st *StreamThings) HandleThingFromMessage(t *Thing) error {
 	return nil
 }
 
+func (st *StreamThings) HandleTombstone(id string) error {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	delete(st.thingCache, id)
+
+	return nil
+}
+
 type codedError struct {
 	error
 	code int
@@ -102,41 +435,124 @@ func (ce codedError) Code() int {
 	return ce.code
 }
 
-func (st *StreamThings) CreateThing(name string, foo float64) (*Thing, error) {
+// commandTimeout is how long the synchronous ThingService methods wait for
+// the updater to apply their commands
+const commandTimeout = 30 * time.Second
+
+// CreateThing creates a Thing, or gets the one an earlier create with the
+// same idempotency key made, if the key isn't empty. Reusing a key for a
+// different create is a 422.
+func (st *StreamThings) CreateThing(key, name string, foo float64) (*Thing, ConsistencyToken, error) {
 	if name == "" {
-		return nil, errors.New("name must be something")
+		return nil, nil, errors.New("name must be something")
 	}
 
 	if foo == 0.0 {
-		return nil, errors.New("foo must not be zero")
+		return nil, nil, errors.New("foo must not be zero")
 	}
 
-	t, err := st.u.CreateThing(name, foo)
+	cs, err := st.CreateThingAsync(key, name, foo)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	st.mux.Lock()
-	defer st.mux.Unlock()
-	st.thingCache[t.ID] = t.Clone()
+	cs = st.waitForCommand(cs)
+
+	// the cache is only written by the consumer, which may already have
+	// applied a newer version, so reads after the write wait for the token
+	t, err := cs.Outcome()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return t, cs.Token, nil
+}
+
+func (st *StreamThings) UpdateThing(id, version, name string, foo float64) (*Thing, ConsistencyToken, error) {
+	cs, err := st.UpdateThingAsync(id, version, name, foo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cs = st.waitForCommand(cs)
 
-	return t, nil
+	t, err := cs.Outcome()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return t, cs.Token, nil
 }
 
-func (st *StreamThings) UpdateThing(id, version, name string, foo float64) (*Thing, error) {
-	t, err := st.u.UpdateThing(id, version, name, foo)
+func (st *StreamThings) DeleteThing(id, version string) (ConsistencyToken, error) {
+	c, err := NewCommand(DeleteCommand)
 	if err != nil {
 		return nil, err
 	}
 
-	st.mux.Lock()
-	defer st.mux.Unlock()
-	st.thingCache[t.ID] = t.Clone()
+	c.ThingID = id
+	c.Version = version
+
+	cs, err := st.submit(c)
+	if err != nil {
+		return nil, err
+	}
+
+	cs = st.waitForCommand(cs)
+
+	_, err = cs.Outcome()
+	if err != nil {
+		return nil, err
+	}
+
+	return cs.Token, nil
+}
+
+// waitForCommand waits up to commandTimeout for the command to finish and
+// returns its latest state
+func (st *StreamThings) waitForCommand(cs *CommandState) *CommandState {
+	select {
+	case <-cs.done:
+	case <-time.After(commandTimeout):
+	}
+
+	latest, err := st.command(cs.Command.ID)
+	if err != nil {
+		return cs
+	}
+
+	return latest
+}
 
-	return t, nil
+// waitForToken waits until the thing topic has been applied as far as the
+// token says
+func (st *StreamThings) waitForToken(after ConsistencyToken) error {
+	if len(after) == 0 {
+		return nil
+	}
+
+	err := st.offsets.WaitFor(st.topic, after, consistencyTimeout)
+	if err != nil {
+		return NewCodedError(
+			errors.Wrap(err, "this instance hasn't caught up with the consistency token yet"),
+			http.StatusGatewayTimeout,
+		)
+	}
+
+	return nil
 }
 
-func (st *StreamThings) GetThing(id string) (*Thing, error) {
+func (st *StreamThings) GetThing(id string, after ConsistencyToken) (*Thing, error) {
+	err := st.checkReady()
+	if err != nil {
+		return nil, err
+	}
+
+	err = st.waitForToken(after)
+	if err != nil {
+		return nil, err
+	}
+
 	st.mux.Lock()
 	defer st.mux.Unlock()
 
@@ -148,7 +564,17 @@ func (st *StreamThings) GetThing(id string) (*Thing, error) {
 	return t.Clone(), nil
 }
 
-func (st *StreamThings) ListThings() ([]*Thing, error) {
+func (st *StreamThings) ListThings(after ConsistencyToken) ([]*Thing, error) {
+	err := st.checkReady()
+	if err != nil {
+		return nil, err
+	}
+
+	err = st.waitForToken(after)
+	if err != nil {
+		return nil, err
+	}
+
 	st.mux.Lock()
 	defer st.mux.Unlock()
 
@@ -157,13 +583,123 @@ func (st *StreamThings) ListThings() ([]*Thing, error) {
 		ts = append(ts, t.Clone())
 	}
 
-	sort.Slice(ts, func(i, j int) bool { return ts[i].ID < ts[j].ID })
+	SortThings(ts)
 
 	return ts, nil
 }
 
-func (st *StreamThings) CheckCommand(cid string) (*Thing, error) {
-	return nil, errors.New("not implemented")
+// HandleCommandFromMessage starts tracking a command, which may have been
+// issued by another instance
+func (st *StreamThings) HandleCommandFromMessage(c *Command) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	cs, exists := st.commands[c.ID]
+	if !exists {
+		// the command topic is read from the start, and there's no need to
+		// track what's already expired
+		if c.Expired() {
+			return
+		}
+
+		st.commands[c.ID] = &CommandState{
+			Command: c,
+			Status:  CommandPending,
+			done:    make(chan struct{}),
+		}
+		return
+	}
+
+	// the result got here first
+	cs.Command = c
+}
+
+func (st *StreamThings) HandleCommandResultFromMessage(cr *CommandResult) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	if cr.Expired() {
+		delete(st.commands, cr.CommandID)
+		return
+	}
+
+	cs, exists := st.commands[cr.CommandID]
+	if !exists {
+		cs = &CommandState{
+			Command: &Command{ID: cr.CommandID},
+			done:    make(chan struct{}),
+		}
+		st.commands[cr.CommandID] = cs
+	}
+
+	cs.Apply(cr)
+}
+
+func (st *StreamThings) CreateThingAsync(key, name string, foo float64) (*CommandState, error) {
+	c, err := NewCommand(CreateCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Name = name
+	c.Foo = foo
+	c.IdempotencyKey = key
+	if key != "" {
+		c.RequestHash = CreateRequestHash(name, foo)
+	}
+
+	return st.submit(c)
+}
+
+func (st *StreamThings) UpdateThingAsync(id, version, name string, foo float64) (*CommandState, error) {
+	c, err := NewCommand(UpdateCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ThingID = id
+	c.Version = version
+	c.Name = name
+	c.Foo = foo
+
+	return st.submit(c)
+}
+
+// submit publishes a command for the updater to apply. The command is tracked
+// right away, so it can be checked on before it comes back around the topic.
+func (st *StreamThings) submit(c *Command) (*CommandState, error) {
+	err := st.kc.PublishCommand(c)
+	if err != nil {
+		return nil, err
+	}
+
+	st.HandleCommandFromMessage(c)
+
+	return st.command(c.ID)
+}
+
+// CheckCommand needs the response topic caught up, or commands from before
+// startup would be missing
+func (st *StreamThings) CheckCommand(cid string) (*CommandState, error) {
+	err := st.checkReady()
+	if err != nil {
+		return nil, err
+	}
+
+	return st.command(cid)
+}
+
+// command looks up a command this instance is tracking, ready or not
+func (st *StreamThings) command(cid string) (*CommandState, error) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	cs, exists := st.commands[cid]
+	if !exists {
+		return nil, NewCodedError(errors.Errorf("no command with id %s, or it has expired", cid), http.StatusNotFound)
+	}
+
+	return cs.Clone(), nil
 }
 
 var _ ThingService = &StreamThings{}
@@ -0,0 +1,96 @@
+package shiny
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+func TestOwnWriteDoesNotOverwriteNewerVersion(t *testing.T) {
+	b := broker.NewMemory(broker.MemoryPartitions)
+	kc := NewKafkaClient(b, "things", "commands", "responses", "")
+
+	st := NewStreamThings(kc, "things", "commands", "responses", nil, time.Minute)
+	close(st.ready)
+
+	now := time.Now()
+	st.HandleThingFromMessage(&Thing{ID: "1", Name: "v0", Foo: 1, CreatedOn: now, UpdatedOn: now, Version: "0"})
+
+	updated := make(chan *Thing)
+	go func() {
+		th, _, err := st.UpdateThing("1", "0", "v1", 1)
+		if err != nil {
+			t.Errorf("update failed: %s", err)
+		}
+		updated <- th
+	}()
+
+	var c *Command
+	for c == nil {
+		st.mux.Lock()
+		for _, cs := range st.commands {
+			c = cs.Command
+		}
+		st.mux.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	// another writer's v2 is applied by the consumer before this instance
+	// hears how its own update went
+	st.HandleThingFromMessage(&Thing{ID: "1", Name: "v2", Foo: 1, CreatedOn: now, UpdatedOn: now, Version: "2"})
+	st.HandleCommandResultFromMessage(ResultOfCommand(c, &Thing{ID: "1", Name: "v1", Foo: 1, CreatedOn: now, UpdatedOn: now, Version: "1"}, nil, nil))
+
+	if th := <-updated; th == nil || th.Version != "1" {
+		t.Fatalf("update returned %+v, want version 1", th)
+	}
+
+	th, err := st.GetThing("1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if th.Version != "2" {
+		t.Errorf("cache has version %s of thing 1, want 2", th.Version)
+	}
+}
+
+func TestStreamForgetsExpiredCommands(t *testing.T) {
+	b := broker.NewMemory(broker.MemoryPartitions)
+	kc := NewKafkaClient(b, "things", "commands", "responses", "")
+
+	st := NewStreamThings(kc, "things", "commands", "responses", nil, time.Minute)
+	close(st.ready)
+
+	old := time.Now().Add(-CommandRetention)
+
+	// replaying the topics skips what's already expired
+	st.HandleCommandFromMessage(&Command{ID: "issued-long-ago", Action: CreateCommand, IssuedOn: old})
+	st.HandleCommandResultFromMessage(&CommandResult{CommandID: "finished-long-ago", Status: CommandSucceeded, FinishedOn: old})
+
+	// and the sweep drops what expires later
+	st.HandleCommandFromMessage(&Command{ID: "finished", Action: CreateCommand, IssuedOn: time.Now()})
+	st.HandleCommandResultFromMessage(&CommandResult{CommandID: "finished", Status: CommandSucceeded, FinishedOn: time.Now()})
+	st.HandleCommandFromMessage(&Command{ID: "pending", Action: CreateCommand, IssuedOn: time.Now()})
+
+	st.mux.Lock()
+	st.commands["finished"].FinishedOn = old
+	st.mux.Unlock()
+
+	go st.sweep(time.Millisecond)
+	defer st.Stop()
+	time.Sleep(20 * time.Millisecond)
+
+	for _, cid := range []string{"issued-long-ago", "finished-long-ago", "finished"} {
+		_, err := st.CheckCommand(cid)
+		if CodeOrDefault(err, 0) != http.StatusNotFound {
+			t.Errorf("checking on expired command %s: got %v, want a 404", cid, err)
+		}
+	}
+
+	cs, err := st.CheckCommand("pending")
+	if err != nil || cs.Status != CommandPending {
+		t.Errorf("pending command wasn't kept: %+v, %v", cs, err)
+	}
+}
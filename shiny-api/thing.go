@@ -1,4 +1,4 @@
-package main
+package shiny
 
 import (
 	"time"
@@ -13,12 +13,18 @@ type Thing struct {
 	Version   string
 }
 
+// ThingService writes return a token for reading the change back, and reads
+// wait until they'd see the changes in the token they're given, if any
 type ThingService interface {
-	CreateThing(name string, foo float64) (*Thing, error)
-	UpdateThing(id, version, name string, foo float64) (*Thing, error)
-	GetThing(id string) (*Thing, error)
-	ListThings() ([]*Thing, error)
-	CheckCommand(cid string) (*Thing, error)
+	CreateThing(key, name string, foo float64) (*Thing, ConsistencyToken, error)
+	UpdateThing(id, version, name string, foo float64) (*Thing, ConsistencyToken, error)
+	DeleteThing(id, version string) (ConsistencyToken, error)
+	GetThing(id string, after ConsistencyToken) (*Thing, error)
+	ListThings(after ConsistencyToken) ([]*Thing, error)
+	CreateThingAsync(key, name string, foo float64) (*CommandState, error)
+	UpdateThingAsync(id, version, name string, foo float64) (*CommandState, error)
+	CheckCommand(cid string) (*CommandState, error)
+	Ready() bool
 }
 
 func (t *Thing) Clone() *Thing {
@@ -1,4 +1,4 @@
-package main
+package shiny
 
 import (
 	"log"
@@ -14,41 +14,171 @@ import (
 )
 
 type Updater struct {
-	kc         *KafkaClient
-	new_topic  string
-	done       chan struct{}
-	ownsThings bool
-	nextID     int
-	mux        *sync.Mutex
-	thingCache map[string]*Thing
-}
-
-func NewUpdater(
-	kc *KafkaClient,
-	new_topic string,
-	ownsThings bool,
-) *Updater {
-	return &Updater{
-		kc:         kc,
-		new_topic:  new_topic,
-		ownsThings: ownsThings,
-		nextID:     0,
-		mux:        &sync.Mutex{},
-		thingCache: make(map[string]*Thing),
+	kc             *KafkaClient
+	new_topic      string
+	command_topic  string
+	response_topic string
+	done           chan struct{}
+	ownsThings     bool
+	nextID         int
+	mux            *sync.Mutex
+	thingCache     map[string]*Thing
+	deleted        map[string]string
+	doneCommands   map[string]time.Time
+	idempotent     map[string]*CommandResult
+	offsets        *OffsetTracker
+	original       *OriginalClient
+	original_topic string
+	control_topic  string
+	control        *ControlState
+	controlLive    bool
+	fooPolicy      FooPolicy
+	id_topic       string
+	ids            *IDAllocator
+	leader_topic   string
+	leader         *Leadership
+
+	// every Updater reads the whole command topic, so a write doesn't have
+	// to be forwarded to the leader. pending holds the commands that arrived
+	// while another Updater was leading, in case this one has to apply them.
+	// promoted tells the command processor to apply them.
+	pending  []*Command
+	promoted chan struct{}
+
+	// thingFence and resultFence keep out writes from leaders that have
+	// since been replaced
+	thingFence  *Fence
+	resultFence *Fence
+
+	// snapshots is nil when the cache isn't snapshotted. resumeFrom holds
+	// the offsets from the snapshot loaded at startup.
+	snapshots     *Snapshotter
+	snapshotEvery time.Duration
+	resumeFrom    map[string]map[int32]int64
+}
+
+// UpdaterConfig sets up an Updater. The thing, command and response topics are
+// required, and everything else is turned off when it's left empty.
+type UpdaterConfig struct {
+	NewTopic      string
+	CommandTopic  string
+	ResponseTopic string
+
+	// OwnsThings is ignored when there's a ControlTopic, which decides
+	OwnsThings bool
+
+	// Original is where writes are forwarded while the original api owns
+	// things. OriginalTopic is mirrored onto the new topic, and reverse
+	// synced to with the FooPolicy when there is one.
+	Original      *OriginalClient
+	OriginalTopic string
+	ControlTopic  string
+	FooPolicy     FooPolicy
+
+	Snapshots     *Snapshotter
+	SnapshotEvery time.Duration
+
+	IDTopic string
+	IDBlock int
+
+	LeaderTopic string
+	LeaderTTL   time.Duration
+}
+
+func NewUpdater(kc *KafkaClient, c *UpdaterConfig) (*Updater, error) {
+	ownsThings := c.OwnsThings
+
+	control := &ControlState{Owner: OriginalOwner}
+	if c.ControlTopic != "" {
+		// the control topic decides who owns things, and until it says
+		// otherwise that's the original api
+		ownsThings = control.Owner == ShinyOwner
+	}
+
+	offsets := NewOffsetTracker()
+
+	var ids *IDAllocator
+	if c.IDTopic != "" {
+		var err error
+		ids, err = NewIDAllocator(kc, c.IDTopic, c.IDBlock, offsets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var leader *Leadership
+	if c.LeaderTopic != "" {
+		var err error
+		leader, err = NewLeadership(kc, c.LeaderTopic, c.LeaderTTL, offsets)
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	return &Updater{
+		kc:             kc,
+		new_topic:      c.NewTopic,
+		command_topic:  c.CommandTopic,
+		response_topic: c.ResponseTopic,
+		done:           make(chan struct{}),
+		ownsThings:     ownsThings,
+		nextID:         0,
+		mux:            &sync.Mutex{},
+		thingCache:     make(map[string]*Thing),
+		deleted:        make(map[string]string),
+		doneCommands:   make(map[string]time.Time),
+		idempotent:     make(map[string]*CommandResult),
+		offsets:        offsets,
+		original:       c.Original,
+		original_topic: c.OriginalTopic,
+		control_topic:  c.ControlTopic,
+		control:        control,
+		fooPolicy:      c.FooPolicy,
+		snapshots:      c.Snapshots,
+		snapshotEvery:  c.SnapshotEvery,
+		id_topic:       c.IDTopic,
+		ids:            ids,
+		leader_topic:   c.LeaderTopic,
+		leader:         leader,
+		promoted:       make(chan struct{}),
+		thingFence:     NewFence(),
+		resultFence:    NewFence(),
+	}, nil
 }
 
+// Start consumes the thing and response topics until it has caught up with
+// them, and only then starts applying commands. That way commands are checked
+// against current Things, and commands that already have results aren't
+// applied a second time.
 func (u *Updater) Start() <-chan error {
-	errs := make(chan error)
+	errs := make(chan error, 1)
+
+	if u.snapshots != nil {
+		u.loadSnapshot()
+	}
 
 	messages := make(chan *sarama.ConsumerMessage)
 
 	go func(c <-chan *sarama.ConsumerMessage) {
 		for cm := range c {
-			t, err := ExtractThingFromMessage(cm)
+			u.handleThingMessage(cm)
+			u.offsets.Applied(cm)
+		}
+	}(messages)
+
+	results := make(chan *sarama.ConsumerMessage)
+
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for cm := range c {
+			if !u.resultFence.Admit(cm) {
+				u.offsets.Applied(cm)
+				continue
+			}
+
+			cr, err := ExtractCommandResultFromMessage(cm)
 			if err != nil {
 				log.Printf(
-					"trouble with message %s|%d|%d:%s (%s): %s: %v",
+					"trouble with command result message %s|%d|%d:%s (%s): %s: %v",
 					cm.Topic,
 					cm.Partition,
 					cm.Offset,
@@ -57,147 +187,1166 @@ func (u *Updater) Start() <-chan error {
 					cm.Value,
 					err,
 				)
-				continue
+			} else {
+				u.HandleCommandResultFromMessage(cr)
 			}
 
-			err = u.HandleThingFromMessage(t)
+			u.offsets.Applied(cm)
+		}
+	}(results)
+
+	originals := make(chan *sarama.ConsumerMessage)
+
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for cm := range c {
+			u.handleOriginalThingMessage(cm)
+			u.offsets.Applied(cm)
+		}
+	}(originals)
+
+	controls := make(chan *sarama.ConsumerMessage)
+
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for cm := range c {
+			e, err := ExtractControlEventFromMessage(cm)
 			if err != nil {
-				log.Printf("error handling thing %+v: %s", t, err)
+				log.Printf(
+					"trouble with control message %s|%d|%d:%s (%s): %s: %v",
+					cm.Topic,
+					cm.Partition,
+					cm.Offset,
+					cm.Key,
+					cm.Timestamp,
+					cm.Value,
+					err,
+				)
+			} else {
+				u.HandleControlEvent(e)
 			}
+
+			u.offsets.Applied(cm)
 		}
-	}(messages)
+	}(controls)
+
+	leases := make(chan *sarama.ConsumerMessage)
+
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for cm := range c {
+			l, err := ExtractIDLeaseFromMessage(cm)
+			if err != nil {
+				log.Printf(
+					"trouble with id lease message %s|%d|%d:%s (%s): %s: %v",
+					cm.Topic,
+					cm.Partition,
+					cm.Offset,
+					cm.Key,
+					cm.Timestamp,
+					cm.Value,
+					err,
+				)
+			} else {
+				u.ids.HandleLease(l)
+			}
+
+			u.offsets.Applied(cm)
+		}
+	}(leases)
+
+	claims := make(chan *sarama.ConsumerMessage)
+
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for cm := range c {
+			lc, err := ExtractLeaderClaimFromMessage(cm)
+			if err != nil {
+				log.Printf(
+					"trouble with leader claim message %s|%d|%d:%s (%s): %s: %v",
+					cm.Topic,
+					cm.Partition,
+					cm.Offset,
+					cm.Key,
+					cm.Timestamp,
+					cm.Value,
+					err,
+				)
+			} else {
+				u.leader.HandleClaim(lc)
+			}
+
+			u.offsets.Applied(cm)
+		}
+	}(claims)
+
+	commands := make(chan *sarama.ConsumerMessage)
+
+	// pending commands are applied in here too, so commands are always
+	// applied in the order they were issued
+	go func(c <-chan *sarama.ConsumerMessage) {
+		for {
+			select {
+			case cm := <-c:
+				cmd, err := ExtractCommandFromMessage(cm)
+				if err != nil {
+					log.Printf(
+						"trouble with command message %s|%d|%d:%s (%s): %s: %v",
+						cm.Topic,
+						cm.Partition,
+						cm.Offset,
+						cm.Key,
+						cm.Timestamp,
+						cm.Value,
+						err,
+					)
+					continue
+				}
+
+				u.HandleCommand(cmd)
+
+			case <-u.promoted:
+				u.applyPending()
+			}
+		}
+	}(commands)
 
 	go func() {
-		err := u.kc.RegisterMessageProcessor(
+		err := u.catchUp(u.new_topic, messages)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		err = u.catchUp(u.response_topic, results)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		if u.id_topic != "" {
+			err = u.catchUp(u.id_topic, leases)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+
+		if u.leader_topic != "" {
+			err = u.catchUp(u.leader_topic, claims)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+
+		if u.original_topic != "" {
+			err = u.catchUp(u.original_topic, originals)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+
+		if u.control_topic != "" {
+			err = u.catchUp(u.control_topic, controls)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			u.mux.Lock()
+			u.controlLive = true
+			owner := u.control.Owner
+			u.mux.Unlock()
+
+			log.Printf("updater caught up with control topic %s, owner is %s", u.control_topic, owner)
+
+			u.act()
+		}
+
+		log.Printf("updater caught up with %s and %s", u.new_topic, u.response_topic)
+
+		if u.snapshots != nil {
+			u.snapshots.Every(u.snapshotEvery, u.snapshot)
+		}
+
+		go u.sweep(sweepEvery)
+
+		err = u.kc.RegisterMessageProcessor(
 			context.Background(),
-			u.new_topic,
+			u.command_topic,
 			5*time.Minute,
-			messages,
+			commands,
 		)
 
 		if err != nil {
 			errs <- err
-		} else {
-			log.Printf("updater message processor registered")
+			return
+		}
+
+		log.Printf("updater command processor registered")
+
+		if u.leader != nil {
+			u.leader.Campaign(u.promote)
 		}
 	}()
 
 	return errs
 }
 
-func (u *Updater) HandleThingFromMessage(t *Thing) error {
+// Stop ends the Updater's periodic work. Its topics stop being read when the
+// broker is closed.
+func (u *Updater) Stop() {
+	close(u.done)
+}
+
+func (u *Updater) catchUp(topic string, c chan<- *sarama.ConsumerMessage) error {
+	err := u.register(topic, c)
+	if err != nil {
+		return err
+	}
+
+	marks, err := u.kc.HighWaterMarks(topic)
+	if err != nil {
+		return err
+	}
+
+	return u.offsets.WaitFor(topic, marks, 5*time.Minute)
+}
+
+// register starts reading a topic where the loaded snapshot left off, or from
+// the start if there's no snapshot or it can't be resumed. The response topic
+// is always read from the start, since the results are what keep commands
+// from being applied twice.
+func (u *Updater) register(topic string, c chan<- *sarama.ConsumerMessage) error {
+	from, exists := u.resumeFrom[topic]
+	if exists {
+		err := u.kc.ResumeMessageProcessor(
+			context.Background(),
+			topic,
+			5*time.Minute,
+			from,
+			c,
+		)
+		if err == nil {
+			u.offsets.Seed(topic, from)
+			log.Printf("updater resumed %s from the snapshot", topic)
+			return nil
+		}
+
+		log.Printf("updater can't resume %s from the snapshot, reading it from the start: %s", topic, err)
+
+		if topic == u.new_topic {
+			u.mux.Lock()
+			u.thingCache = make(map[string]*Thing)
+			u.deleted = make(map[string]string)
+			u.nextID = 0
+			u.mux.Unlock()
+
+			u.thingFence.Seed(nil)
+		}
+	}
+
+	return u.kc.RegisterMessageProcessor(
+		context.Background(),
+		topic,
+		5*time.Minute,
+		c,
+	)
+}
+
+// loadSnapshot fills the cache from the newest snapshot, if there is one
+func (u *Updater) loadSnapshot() {
+	s, err := u.snapshots.Load()
+	if err != nil {
+		log.Printf("trouble loading snapshot: %s", err)
+	}
+
+	if s == nil {
+		return
+	}
+
 	u.mux.Lock()
 	defer u.mux.Unlock()
 
-	if x, exists := u.thingCache[t.ID]; exists {
-		tv, err := strconv.Atoi(t.Version)
-		if err != nil {
-			return err
+	u.thingCache = s.Cache()
+	u.deleted = make(map[string]string)
+	for id, version := range s.Deleted {
+		u.deleted[id] = version
+	}
+	u.nextID = s.NextID
+	for id := range u.thingCache {
+		u.sawID(id)
+	}
+	u.thingFence.Seed(s.Epochs)
+
+	u.resumeFrom = make(map[string]map[int32]int64)
+	for _, topic := range []string{u.new_topic, u.original_topic} {
+		if from, exists := s.Offsets[topic]; exists && topic != "" {
+			u.resumeFrom[topic] = from
 		}
+	}
+
+	log.Printf("updater loaded the snapshot taken on %s", s.TakenOn)
+}
+
+// snapshot copies the cache along with how far the thing topics have been
+// applied. The offsets are read first, so the cache is never behind them, and
+// the epochs before that, so they're never ahead.
+func (u *Updater) snapshot() *Snapshot {
+	epochs := u.thingFence.Epochs()
+	offsets := map[string]map[int32]int64{
+		u.new_topic: u.offsets.Next(u.new_topic),
+	}
+	if u.original_topic != "" {
+		offsets[u.original_topic] = u.offsets.Next(u.original_topic)
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
 
-		xv, err := strconv.Atoi(x.Version)
+	s := NewSnapshot(u.thingCache)
+	s.Offsets = offsets
+	s.NextID = u.nextID
+	s.Epochs = epochs
+	for id, version := range u.deleted {
+		s.Deleted[id] = version
+	}
+
+	return s
+}
+
+func (u *Updater) handleThingMessage(cm *sarama.ConsumerMessage) {
+	if !u.thingFence.Admit(cm) {
+		return
+	}
+
+	if IsTombstone(cm) {
+		err := u.HandleTombstone(string(cm.Key))
 		if err != nil {
-			return err
+			log.Printf("error handling tombstone for %s: %s", cm.Key, err)
 		}
+		return
+	}
 
-		if xv >= tv {
-			// the thing we have is already equal or newer than the thing in the
-			// message
-			return nil
+	t, err := ExtractThingFromMessage(cm)
+	if err != nil {
+		log.Printf(
+			"trouble with message %s|%d|%d:%s (%s): %s: %v",
+			cm.Topic,
+			cm.Partition,
+			cm.Offset,
+			cm.Key,
+			cm.Timestamp,
+			cm.Value,
+			err,
+		)
+		return
+	}
+
+	err = u.HandleThingFromMessage(t)
+	if err != nil {
+		log.Printf("error handling thing %+v: %s", t, err)
+	}
+}
+
+func (u *Updater) handleOriginalThingMessage(cm *sarama.ConsumerMessage) {
+	if IsTombstone(cm) {
+		err := u.MirrorTombstone(string(cm.Key))
+		if err != nil {
+			log.Printf("error mirroring original tombstone for %s: %s", cm.Key, err)
 		}
+		return
 	}
 
-	u.thingCache[t.ID] = t.Clone()
+	t, err := ExtractOriginalThingFromMessage(cm)
+	if err != nil {
+		log.Printf(
+			"trouble with original message %s|%d|%d:%s (%s): %s: %v",
+			cm.Topic,
+			cm.Partition,
+			cm.Offset,
+			cm.Key,
+			cm.Timestamp,
+			cm.Value,
+			err,
+		)
+		return
+	}
 
-	return nil
+	err = u.MirrorThing(t)
+	if err != nil {
+		log.Printf("error mirroring original thing %+v: %s", t, err)
+	}
 }
 
-func (u *Updater) CreateThing(name string, foo float64) (*Thing, error) {
+func (u *Updater) HandleCommandResultFromMessage(cr *CommandResult) {
 	u.mux.Lock()
 	defer u.mux.Unlock()
 
-	var t *Thing
+	// commands whose results have expired are skipped by HandleCommand, so
+	// there's no need to remember them
+	if !cr.Expired() {
+		u.doneCommands[cr.CommandID] = cr.FinishedOn
+	}
+
+	// the response topic is replayed at startup, so every Updater knows the
+	// creates that can still be retried
+	if cr.IdempotencyKey != "" && cr.Status == CommandSucceeded && time.Since(cr.FinishedOn) < IdempotencyWindow {
+		if _, exists := u.idempotent[cr.IdempotencyKey]; !exists {
+			u.idempotent[cr.IdempotencyKey] = cr
+		}
+	}
+
+	for i, c := range u.pending {
+		if c.ID == cr.CommandID {
+			u.pending = append(u.pending[:i], u.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// promote gets a newly elected Updater ready to apply writes. It fences off
+// the topics it writes, so nothing the old leader still gets in counts, and
+// reads up to the fences, so compare-and-set checks see everything that does.
+func (u *Updater) promote() {
+	epoch, leading := u.leader.Term()
+	if !leading {
+		return
+	}
 
-	if u.ownsThings {
-		now := time.Now()
-		t = &Thing{
-			ID:        strconv.Itoa(u.nextID),
-			Name:      name,
-			Foo:       foo,
-			CreatedOn: now,
-			UpdatedOn: now,
-			Version:   "0",
+	for _, topic := range []string{u.new_topic, u.response_topic} {
+		tok, err := u.kc.PublishFences(topic, epoch)
+		if err == nil {
+			err = u.offsets.WaitFor(topic, tok, 5*time.Minute)
+		}
+		if err != nil {
+			log.Printf("trouble fencing %s after being elected: %s", topic, err)
+			return
 		}
+	}
+
+	log.Printf("updater is leading in epoch %d, applying writes", epoch)
+
+	u.promoted <- struct{}{}
+
+	u.mux.Lock()
+	live := u.controlLive
+	u.mux.Unlock()
+
+	if live {
+		u.act()
+	}
+}
+
+// applyPending applies the commands that came in while another Updater was
+// leading and haven't got results yet
+func (u *Updater) applyPending() {
+	u.mux.Lock()
+	pending := u.pending
+	u.pending = nil
+	u.mux.Unlock()
+
+	for _, c := range pending {
+		u.HandleCommand(c)
+	}
+}
+
+// HandleCommand applies a command and publishes its result, unless it already
+// has one. Only the leader applies commands. The rest keep them until they've
+// got results, since every Updater reads the command topic and there's
+// nothing to forward.
+func (u *Updater) HandleCommand(c *Command) {
+	u.mux.Lock()
+	_, done := u.doneCommands[c.ID]
+	u.mux.Unlock()
+
+	if done {
+		return
+	}
+
+	// the command topic is read from the start, and an expired command's
+	// result has been forgotten, so applying it again could repeat it
+	if c.Expired() {
+		return
+	}
+
+	if u.leader != nil && !u.leader.Leading() {
+		u.requeue(c)
+		return
+	}
+
+	if c.Action == CreateCommand && c.IdempotencyKey != "" {
+		prior := u.idempotentResult(c.IdempotencyKey)
+		if prior != nil {
+			epoch, err := u.term()
+			if err != nil {
+				u.requeue(c)
+				return
+			}
+
+			var cr CommandResult
+			if prior.RequestHash != "" && prior.RequestHash != c.RequestHash {
+				// results from before requests were hashed replay any
+				// request
+				cr = *ResultOfCommand(c, nil, nil, NewCodedError(
+					errors.New("the idempotency key was already used for a different create"),
+					http.StatusUnprocessableEntity,
+				))
+			} else {
+				cr = *prior
+				cr.CommandID = c.ID
+				cr.Replayed = true
+			}
+			cr.Epoch = epoch
+
+			err = u.kc.PublishCommandResult(&cr)
+			if err != nil {
+				log.Printf("failed to publish replayed result %+v for command %s: %s", cr, c.ID, err)
+				return
+			}
 
-		_, exists := u.thingCache[t.ID]
-		if exists {
-			return nil, errors.Errorf("a thing with id %s already exists", t.ID)
+			u.HandleCommandResultFromMessage(&cr)
+			return
 		}
+	}
+
+	var t *Thing
+	var tok ConsistencyToken
+	var err error
+
+	switch c.Action {
+	case CreateCommand:
+		t, tok, err = u.CreateThing(c.IdempotencyKey, c.Name, c.Foo)
+
+	case UpdateCommand:
+		t, tok, err = u.UpdateThing(c.ThingID, c.Version, c.Name, c.Foo)
+
+	case DeleteCommand:
+		tok, err = u.DeleteThing(c.ThingID, c.Version)
 
-		u.nextID = u.nextID + 1
+	default:
+		err = errors.Errorf("unknown command action %q", c.Action)
+	}
+
+	cr := ResultOfCommand(c, t, tok, err)
+
+	// applying the command can take a while, so the result is only published
+	// if this Updater is still leading
+	cr.Epoch, err = u.term()
+	if err != nil {
+		u.requeue(c)
+		return
+	}
+
+	err = u.kc.PublishCommandResult(cr)
+	if err != nil {
+		log.Printf("failed to publish result %+v for command %s: %s", cr, c.ID, err)
+		return
+	}
 
+	u.HandleCommandResultFromMessage(cr)
+}
+
+// requeue keeps a command this Updater can't apply, in case it gets to later
+func (u *Updater) requeue(c *Command) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.pending = append(u.pending, c)
+}
+
+// term is the epoch to stamp what the Updater writes with. It's checked again
+// right before each write is published, since leadership can run out while
+// the write is being made. Without an election every write is from epoch 0.
+func (u *Updater) term() (int64, error) {
+	if u.leader == nil {
+		return 0, nil
+	}
+
+	epoch, leading := u.leader.Term()
+	if !leading {
+		return 0, NewCodedError(errors.New("this updater is no longer leading"), http.StatusServiceUnavailable)
+	}
+
+	return epoch, nil
+}
+
+// idempotentResult is the result of the create with the key, if it's recent
+// enough to replay
+func (u *Updater) idempotentResult(key string) *CommandResult {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	cr, exists := u.idempotent[key]
+	if !exists {
+		return nil
+	}
+
+	if time.Since(cr.FinishedOn) >= IdempotencyWindow {
+		delete(u.idempotent, key)
+		return nil
+	}
+
+	return cr
+}
+
+// sweep drops expired idempotency keys and commands every so often until the
+// Updater is stopped
+func (u *Updater) sweep(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+
+		case <-ticker.C:
+			u.mux.Lock()
+			for key, cr := range u.idempotent {
+				if time.Since(cr.FinishedOn) >= IdempotencyWindow {
+					delete(u.idempotent, key)
+				}
+			}
+
+			for id, finished := range u.doneCommands {
+				if time.Since(finished) >= CommandRetention {
+					delete(u.doneCommands, id)
+				}
+			}
+
+			pending := u.pending[:0]
+			for _, c := range u.pending {
+				if !c.Expired() {
+					pending = append(pending, c)
+				}
+			}
+			u.pending = pending
+			u.mux.Unlock()
+		}
+	}
+}
+
+// HandleControlEvent folds a control event into the mastership state. Writes
+// the Updater makes itself hold u.mux, so none are in flight once a freeze has
+// been applied. Writes forwarded to the original api don't, but it's the
+// original api's freeze that stops those.
+func (u *Updater) HandleControlEvent(e *ControlEvent) {
+	u.mux.Lock()
+	u.control.Apply(e)
+	u.ownsThings = u.control.Owner == ShinyOwner
+	live := u.controlLive
+	u.mux.Unlock()
+
+	if live {
+		u.act()
+	}
+}
+
+// act does the Updater's part of a handoff in progress. As the new master it
+// waits until everything the old master published has been mirrored, and then
+// takes over. As the old master it reports the marks of the new topic. Only
+// the leader acts, and a newly elected one acts on promotion.
+func (u *Updater) act() {
+	if u.leader != nil && !u.leader.Leading() {
+		return
+	}
+
+	u.mux.Lock()
+	var h *Handoff
+	if u.control.Handoff != nil {
+		x := *u.control.Handoff
+		h = &x
+	}
+	u.mux.Unlock()
+
+	if h == nil {
+		return
+	}
+
+	switch {
+	case h.Stage == FrozenEvent && h.To == ShinyOwner:
+		go func() {
+			err := u.offsets.WaitFor(u.original_topic, h.Marks, 5*time.Minute)
+			if err != nil {
+				log.Printf("gave up on handoff %s: %s", h.ID, err)
+				return
+			}
+
+			err = u.kc.PublishControlEvent(&ControlEvent{
+				Type:     OwnerEvent,
+				Handoff:  h.ID,
+				Owner:    ShinyOwner,
+				IssuedOn: time.Now(),
+			})
+			if err != nil {
+				log.Printf("failed to take over for handoff %s: %s", h.ID, err)
+			}
+		}()
+
+	case h.Stage == FreezeEvent && h.From == ShinyOwner:
+		go func() {
+			marks, err := u.kc.HighWaterMarks(u.new_topic)
+			if err != nil {
+				log.Printf("failed to get marks for handoff %s: %s", h.ID, err)
+				return
+			}
+
+			err = u.kc.PublishControlEvent(&ControlEvent{
+				Type:     FrozenEvent,
+				Handoff:  h.ID,
+				From:     h.From,
+				To:       h.To,
+				Marks:    marks,
+				IssuedOn: time.Now(),
+			})
+			if err != nil {
+				log.Printf("failed to report frozen for handoff %s: %s", h.ID, err)
+			}
+		}()
+	}
+}
+
+// canWrite says why the Updater can't write right now, if it can't. u.mux
+// must be held.
+func (u *Updater) canWrite() error {
+	if u.control_topic == "" {
+		return nil
+	}
+
+	if !u.controlLive {
+		return NewCodedError(errors.New("still catching up with the control topic"), http.StatusServiceUnavailable)
+	}
+
+	if u.control.Frozen && u.control.Handoff != nil && u.control.Handoff.From == ShinyOwner {
+		return NewCodedError(errors.New("writes are frozen for a handoff"), http.StatusServiceUnavailable)
+	}
+
+	return nil
+}
+
+// sawID keeps nextID past every numeric id, so Things minted after taking over
+// from the original api don't collide with mirrored ones, and ids aren't
+// reused after a restart. u.mux must be held.
+func (u *Updater) sawID(id string) {
+	i, err := strconv.Atoi(id)
+	if err != nil {
+		return
+	}
+
+	if i >= u.nextID {
+		u.nextID = i + 1
+	}
+}
+
+// reverseSyncing reports whether the Things the Updater writes are also
+// published to the original topic, so its consumers keep up after cutover
+func (u *Updater) reverseSyncing() bool {
+	return u.original_topic != "" && u.fooPolicy != ""
+}
+
+// newerThanCached reports whether t is a later version than the cached copy
+// of the same Thing, or than the version it was deleted at. The original topic
+// still has every version of a deleted Thing when it's replayed, and
+// mirroring them would bring the Thing back. u.mux must be held.
+func (u *Updater) newerThanCached(t *Thing) (bool, error) {
+	var known string
+
+	if x, exists := u.thingCache[t.ID]; exists {
+		known = x.Version
+	} else if v, deleted := u.deleted[t.ID]; deleted {
+		// ids aren't reused, so a deletion whose version was compacted
+		// away is later than anything
+		if v == "" {
+			return false, nil
+		}
+		known = v
 	} else {
-		return nil, errors.New("not owning Things isn't supported yet")
+		return true, nil
 	}
 
-	err := u.kc.PublishThing(t)
+	tv, err := strconv.Atoi(t.Version)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
+	kv, err := strconv.Atoi(known)
+	if err != nil {
+		return false, err
+	}
+
+	return tv > kv, nil
+}
+
+// cache keeps a copy of the latest version of a Thing. u.mux must be held.
+func (u *Updater) cache(t *Thing) {
 	u.thingCache[t.ID] = t.Clone()
+	delete(u.deleted, t.ID)
+}
+
+// forget drops a deleted Thing from the cache, remembering the version it was
+// deleted at. u.mux must be held.
+func (u *Updater) forget(id string) {
+	version := u.deleted[id]
+	if x, exists := u.thingCache[id]; exists {
+		version = x.Version
+	}
 
-	return t, nil
+	u.deleted[id] = version
+	delete(u.thingCache, id)
 }
 
-func (u *Updater) UpdateThing(id, version, name string, foo float64) (*Thing, error) {
+func (u *Updater) HandleThingFromMessage(t *Thing) error {
 	u.mux.Lock()
 	defer u.mux.Unlock()
 
-	var t *Thing
+	newer, err := u.newerThanCached(t)
+	if err != nil {
+		return err
+	}
+
+	if !newer {
+		// the thing we have is already equal or newer than the thing in the
+		// message
+		return nil
+	}
+
+	u.cache(t)
+	u.sawID(t.ID)
+
+	return nil
+}
+
+// MirrorThing republishes a Thing from the original topic onto the new topic,
+// unless the new topic already has that version or a later one
+func (u *Updater) MirrorThing(t *Thing) error {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	_, err := u.mirror(t)
+	return err
+}
+
+// mirror publishes t to the new topic if it's newer than what's there, and
+// returns a token for reading it back either way. u.mux must be held.
+func (u *Updater) mirror(t *Thing) (ConsistencyToken, error) {
+	newer, err := u.newerThanCached(t)
+	if err != nil {
+		return nil, err
+	}
+
+	if !newer {
+		// whatever got there first has already been published
+		return u.caughtUpToken()
+	}
+
+	// every Updater mirrors, so mirrored Things aren't fenced
+	tok, err := u.kc.PublishThing(t, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	u.cache(t)
+	u.sawID(t.ID)
+
+	return tok, nil
+}
+
+// MirrorTombstone republishes a deletion from the original topic onto the new
+// topic, if the Thing is still around
+func (u *Updater) MirrorTombstone(id string) error {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	_, err := u.mirrorTombstone(id)
+	return err
+}
+
+// mirrorTombstone is the tombstone version of mirror. u.mux must be held.
+func (u *Updater) mirrorTombstone(id string) (ConsistencyToken, error) {
+	if _, exists := u.thingCache[id]; !exists {
+		return u.caughtUpToken()
+	}
+
+	tok, err := u.kc.PublishTombstone(id)
+	if err != nil {
+		return nil, err
+	}
+
+	u.forget(id)
 
-	if u.ownsThings {
-		var exists bool
-		t, exists = u.thingCache[id]
-		if !exists {
-			return nil, NewCodedError(errors.Errorf("no Thing with id %s", id), http.StatusNotFound)
+	return tok, nil
+}
+
+// caughtUpToken covers everything published to the new topic so far
+func (u *Updater) caughtUpToken() (ConsistencyToken, error) {
+	marks, err := u.kc.HighWaterMarks(u.new_topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return ConsistencyToken(marks), nil
+}
+
+func (u *Updater) HandleTombstone(id string) error {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.forget(id)
+
+	// compaction can leave only the tombstone, which still means the id has
+	// been used
+	u.sawID(id)
+
+	return nil
+}
+
+// CreateThing mints a Thing, or has the original api mint it. The idempotency
+// key is passed along to the original api, which keeps its own.
+func (u *Updater) CreateThing(key, name string, foo float64) (*Thing, ConsistencyToken, error) {
+	u.mux.Lock()
+
+	err := u.canWrite()
+	if err != nil {
+		u.mux.Unlock()
+		return nil, nil, err
+	}
+
+	if !u.ownsThings {
+		u.mux.Unlock()
+
+		// the original api mints the thing. It's mirrored right away, so it
+		// can be read back without waiting for the original topic to echo it.
+		return u.forwarded(u.original.CreateThing(key, name, foo))
+	}
+
+	id := u.nextID
+
+	if u.ids != nil {
+		// leasing a block of ids waits on the id topic, so it's done without
+		// holding u.mux, and the write is checked again afterwards
+		u.mux.Unlock()
+
+		id, err = u.ids.Next(id)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		if t.Version != version {
-			return nil, NewCodedError(errors.New("version conflict"), http.StatusConflict)
+		u.mux.Lock()
+
+		err = u.canWrite()
+		if err == nil && !u.ownsThings {
+			err = NewCodedError(errors.New("the original api took over things"), http.StatusServiceUnavailable)
 		}
+		if err != nil {
+			u.mux.Unlock()
+			return nil, nil, err
+		}
+	}
+
+	defer u.mux.Unlock()
+
+	now := time.Now()
+	t := &Thing{
+		ID:        strconv.Itoa(id),
+		Name:      name,
+		Foo:       foo,
+		CreatedOn: now,
+		UpdatedOn: now,
+		Version:   "0",
+	}
+
+	_, exists := u.thingCache[t.ID]
+	if exists {
+		return nil, nil, errors.Errorf("a thing with id %s already exists", t.ID)
+	}
+
+	tok, err := u.publish(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u.sawID(t.ID)
+	u.cache(t)
+
+	return t, tok, nil
+}
+
+func (u *Updater) UpdateThing(id, version, name string, foo float64) (*Thing, ConsistencyToken, error) {
+	u.mux.Lock()
+
+	err := u.canWrite()
+	if err != nil {
+		u.mux.Unlock()
+		return nil, nil, err
+	}
 
-		var changed bool
+	if !u.ownsThings {
+		// the original api wants every field on an update
+		if x, exists := u.thingCache[id]; exists {
+			if name == "" {
+				name = x.Name
+			}
 
-		if name != "" {
-			t.Name = name
-			changed = true
+			if foo == 0 {
+				foo = x.Foo
+			}
 		}
 
-		if foo != 0 {
-			t.Foo = foo
-			changed = true
+		u.mux.Unlock()
+
+		return u.forwarded(u.original.UpdateThing(id, version, name, foo))
+	}
+
+	defer u.mux.Unlock()
+
+	x, exists := u.thingCache[id]
+	if !exists {
+		return nil, nil, NewCodedError(errors.Errorf("no Thing with id %s", id), http.StatusNotFound)
+	}
+
+	// the cached copy is only replaced once the change is published
+	t := x.Clone()
+
+	if t.Version != version {
+		return nil, nil, NewCodedError(errors.New("version conflict"), http.StatusConflict)
+	}
+
+	var changed bool
+
+	if name != "" {
+		t.Name = name
+		changed = true
+	}
+
+	if foo != 0 {
+		t.Foo = foo
+		changed = true
+	}
+
+	if changed {
+		v, err := strconv.Atoi(t.Version)
+		if err != nil {
+			return nil, nil, err
 		}
+		t.Version = strconv.Itoa(v + 1)
+		t.UpdatedOn = time.Now()
+	}
 
-		if changed {
-			v, err := strconv.Atoi(t.Version)
-			if err != nil {
-				return nil, err
-			}
-			t.Version = strconv.Itoa(v + 1)
-			t.UpdatedOn = time.Now()
+	tok, err := u.publish(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u.cache(t)
+
+	return t, tok, nil
+}
+
+func (u *Updater) DeleteThing(id, version string) (ConsistencyToken, error) {
+	u.mux.Lock()
+
+	err := u.canWrite()
+	if err != nil {
+		u.mux.Unlock()
+		return nil, err
+	}
+
+	if !u.ownsThings {
+		u.mux.Unlock()
+
+		err := u.original.DeleteThing(id, version)
+		if err != nil {
+			return nil, err
 		}
 
-	} else {
-		return nil, errors.New("not owning Things isn't supported yet")
+		u.mux.Lock()
+		defer u.mux.Unlock()
+
+		return u.mirrorTombstone(id)
+	}
+
+	defer u.mux.Unlock()
+
+	t, exists := u.thingCache[id]
+	if !exists {
+		return nil, NewCodedError(errors.Errorf("no Thing with id %s", id), http.StatusNotFound)
+	}
+
+	if t.Version != version {
+		return nil, NewCodedError(errors.New("version conflict"), http.StatusConflict)
 	}
 
-	err := u.kc.PublishThing(t)
+	// tombstones can't carry an epoch, so this is as close as a delete gets
+	// to being fenced
+	_, err = u.term()
 	if err != nil {
 		return nil, err
 	}
 
-	u.thingCache[t.ID] = t.Clone()
+	tok, err := u.kc.PublishTombstone(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.reverseSyncing() {
+		err = u.kc.PublishOriginalTombstone(u.original_topic, id)
+		if err != nil {
+			log.Printf("failed to reverse sync tombstone for thing %s: %s", id, err)
+		}
+	}
+
+	u.forget(id)
+
+	return tok, nil
+}
+
+// forwarded mirrors the Thing the original api came back with from a write.
+// The write itself is made without holding u.mux, so the Updater keeps
+// consuming its topics while it waits on the original api.
+func (u *Updater) forwarded(t *Thing, err error) (*Thing, ConsistencyToken, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	tok, err := u.mirror(t)
+	return t, tok, err
+}
+
+// publish publishes a Thing the Updater has written to the new topic and, when
+// reverse syncing, to the original topic. A foo the FooPolicy refuses fails
+// the write before anything is published. u.mux must be held.
+func (u *Updater) publish(t *Thing) (ConsistencyToken, error) {
+	var oe *OriginalThingEntry
+	if u.reverseSyncing() {
+		var err error
+		oe, err = OriginalEntryFromThing(t, u.fooPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	epoch, err := u.term()
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := u.kc.PublishThing(t, epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	if oe == nil {
+		return tok, nil
+	}
+
+	// the new topic is the source of truth once the Updater owns things, so
+	// a failure here is only logged
+	err = u.kc.PublishOriginalThing(u.original_topic, oe)
+	if err != nil {
+		log.Printf("failed to reverse sync thing %s: %s", t.ID, err)
+	}
 
-	return t, nil
+	return tok, nil
 }
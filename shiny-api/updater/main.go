@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/apiarian/migration-playground/broker"
+	shiny "github.com/apiarian/migration-playground/shiny-api"
+)
+
+var broker_kind string
+var brokers string
+var new_topic string
+var command_topic string
+var response_topic string
+var snapshot_dir string
+var snapshot_every time.Duration
+var owns_things bool
+var original_api string
+var original_topic string
+var control_topic string
+var reverse_sync string
+var id_topic string
+var id_block int
+var leader_topic string
+var leader_ttl time.Duration
+
+func init() {
+	flag.StringVar(
+		&broker_kind,
+		"broker",
+		"kafka",
+		"what carries the topics: kafka, memory to keep them in this process, or file://dir[?compact=topic,...] to keep them on disk in dir, shared with every command pointed at it, compacting the listed topics",
+	)
+	flag.StringVar(
+		&brokers,
+		"brokers",
+		"127.0.0.1:9092",
+		"addresses of the kafka brokers to talk to",
+	)
+	flag.StringVar(
+		&new_topic,
+		"new-topic",
+		fmt.Sprintf("thing-commands-%d", time.Now().Unix()),
+		"the topic for tracking things for the shiny api",
+	)
+	flag.StringVar(
+		&command_topic,
+		"command-topic",
+		fmt.Sprintf("thing-command-requests-%d", time.Now().Unix()),
+		"the topic on which commands to change things are published",
+	)
+	flag.StringVar(
+		&response_topic,
+		"response-topic",
+		fmt.Sprintf("thing-command-responses-%d", time.Now().Unix()),
+		"the topic on which the outcomes of commands are published",
+	)
+	flag.BoolVar(
+		&owns_things,
+		"owns-things",
+		true,
+		"whether the shiny api owns things, or forwards writes to the original api",
+	)
+	flag.StringVar(
+		&original_api,
+		"original-api",
+		"http://127.0.0.1:3000",
+		"base URL of the original api, used when not owning things",
+	)
+	flag.StringVar(
+		&original_topic,
+		"original-topic",
+		"",
+		"the original api's topic, which is mirrored onto the new topic",
+	)
+	flag.StringVar(
+		&control_topic,
+		"control-topic",
+		"",
+		"the topic that says which api owns things, overriding -owns-things",
+	)
+	flag.StringVar(
+		&reverse_sync,
+		"reverse-sync",
+		string(shiny.RejectFoo),
+		"what to do with a foo that isn't a whole number when publishing to the original topic: reject, round or flag; empty turns reverse sync off",
+	)
+	flag.StringVar(
+		&snapshot_dir,
+		"snapshot-dir",
+		"",
+		"directory for snapshots of the thing cache, so restarts don't replay every topic; empty turns snapshots off",
+	)
+	flag.DurationVar(
+		&snapshot_every,
+		"snapshot-every",
+		time.Minute,
+		"how often to snapshot the thing cache",
+	)
+	flag.StringVar(
+		&id_topic,
+		"id-topic",
+		"",
+		"the topic on which updaters lease blocks of thing ids, needed when running more than one; empty mints ids from the things already seen",
+	)
+	flag.IntVar(
+		&id_block,
+		"id-block",
+		100,
+		"how many thing ids to lease at a time",
+	)
+	flag.StringVar(
+		&leader_topic,
+		"leader-topic",
+		"",
+		"the topic on which updaters elect the one that applies writes, needed when running more than one; empty always applies them",
+	)
+	flag.DurationVar(
+		&leader_ttl,
+		"leader-ttl",
+		10*time.Second,
+		"how long a leader's claim lasts without being renewed",
+	)
+}
+
+func main() {
+	flag.Parse()
+
+	b, err := broker.Open(broker_kind, strings.Split(brokers, ","))
+	if err != nil {
+		log.Fatal("failed to open broker: ", err)
+	}
+	log.Print("using the ", broker_kind, " broker")
+
+	kc := shiny.NewKafkaClient(
+		b,
+		new_topic,
+		command_topic,
+		response_topic,
+		control_topic,
+	)
+	defer kc.Close()
+
+	log.Print("things are on ", new_topic)
+	log.Print("commands are on ", command_topic)
+	log.Print("command responses are on ", response_topic)
+
+	if control_topic != "" {
+		log.Print("following mastership on ", control_topic)
+	}
+
+	if !owns_things || control_topic != "" {
+		if original_topic == "" {
+			log.Fatal("-original-topic is required when the original api may own things")
+		}
+
+		log.Print("forwarding writes to ", original_api)
+	}
+
+	var fooPolicy shiny.FooPolicy
+	if original_topic != "" {
+		log.Printf("mirroring things from %s to %s", original_topic, new_topic)
+
+		if reverse_sync != "" {
+			fooPolicy, err = shiny.ParseFooPolicy(reverse_sync)
+			if err != nil {
+				log.Fatal("bad -reverse-sync: ", err)
+			}
+			log.Printf("reverse syncing things to %s, with the %s foo policy", original_topic, fooPolicy)
+		}
+	}
+
+	var snapshots *shiny.Snapshotter
+	if snapshot_dir != "" {
+		snapshots = shiny.NewSnapshotter(snapshot_dir, "updater-"+new_topic)
+		log.Printf("snapshotting things to %s every %s", snapshot_dir, snapshot_every)
+	}
+
+	if id_topic != "" {
+		log.Printf("leasing thing ids on %s, %d at a time", id_topic, id_block)
+	}
+
+	if leader_topic != "" {
+		log.Printf("electing a leader on %s", leader_topic)
+	}
+
+	u, err := shiny.NewUpdater(kc, &shiny.UpdaterConfig{
+		NewTopic:      new_topic,
+		CommandTopic:  command_topic,
+		ResponseTopic: response_topic,
+		OwnsThings:    owns_things,
+		Original:      shiny.NewOriginalClient(original_api),
+		OriginalTopic: original_topic,
+		ControlTopic:  control_topic,
+		FooPolicy:     fooPolicy,
+		Snapshots:     snapshots,
+		SnapshotEvery: snapshot_every,
+		IDTopic:       id_topic,
+		IDBlock:       id_block,
+		LeaderTopic:   leader_topic,
+		LeaderTTL:     leader_ttl,
+	})
+	if err != nil {
+		log.Fatal("failed to set up the updater: ", err)
+	}
+
+	uErrs := u.Start()
+	defer u.Stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	select {
+	case <-signals:
+		log.Print("got an interrupt")
+
+	case err := <-uErrs:
+		log.Print("updater start error: ", err)
+	}
+
+	log.Print("really done now.")
+}
@@ -0,0 +1,284 @@
+package shiny
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/apiarian/migration-playground/broker"
+)
+
+// startUpdater starts an Updater, which is stopped when the test ends, and
+// waits until it has mirrored everything on the original topic
+func startUpdater(t *testing.T, kc *KafkaClient, c *UpdaterConfig) *Updater {
+	u, err := NewUpdater(kc, c)
+	if err != nil {
+		t.Fatalf("failed to set up the updater: %s", err)
+	}
+
+	errs := u.Start()
+	t.Cleanup(u.Stop)
+
+	marks, err := kc.HighWaterMarks(c.OriginalTopic)
+	if err != nil {
+		t.Fatalf("failed to get the original topic's marks: %s", err)
+	}
+
+	err = u.offsets.WaitFor(c.OriginalTopic, marks, 5*time.Second)
+	if err != nil {
+		select {
+		case err := <-errs:
+			t.Fatalf("updater failed to start: %s", err)
+		default:
+		}
+		t.Fatalf("updater didn't catch up: %s", err)
+	}
+
+	return u
+}
+
+func countMessages(t *testing.T, kc *KafkaClient, topic string) int64 {
+	marks, err := kc.HighWaterMarks(topic)
+	if err != nil {
+		t.Fatalf("failed to get the marks of %s: %s", topic, err)
+	}
+
+	var n int64
+	for _, o := range marks {
+		n += o
+	}
+
+	return n
+}
+
+func TestMirrorDoesNotBringBackDeletedThings(t *testing.T) {
+	b := broker.NewMemory(broker.MemoryPartitions)
+	kc := NewKafkaClient(b, "things", "commands", "responses", "")
+
+	c := &UpdaterConfig{
+		NewTopic:      "things",
+		CommandTopic:  "commands",
+		ResponseTopic: "responses",
+		OwnsThings:    true,
+		OriginalTopic: "original",
+	}
+
+	now := time.Now()
+	for v := 0; v < 3; v++ {
+		err := kc.PublishOriginalThing(c.OriginalTopic, &OriginalThingEntry{
+			ID:        7,
+			Name:      "seven",
+			Foo:       7 + v,
+			CreatedOn: now,
+			UpdatedOn: now,
+			Version:   v,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := kc.PublishOriginalTombstone(c.OriginalTopic, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startUpdater(t, kc, c)
+
+	mirrored := countMessages(t, kc, c.NewTopic)
+	if mirrored != 4 {
+		t.Fatalf("expected three versions and a tombstone on the new topic, found %d messages", mirrored)
+	}
+
+	// a restart without a snapshot replays both topics from the start
+	u := startUpdater(t, kc, c)
+
+	if n := countMessages(t, kc, c.NewTopic); n != mirrored {
+		t.Errorf("replaying the original topic published %d more messages", n-mirrored)
+	}
+
+	u.mux.Lock()
+	_, cached := u.thingCache["7"]
+	version := u.deleted["7"]
+	u.mux.Unlock()
+
+	if cached {
+		t.Errorf("deleted thing 7 is back in the cache")
+	}
+
+	if version != "2" {
+		t.Errorf("expected thing 7 to be deleted at version 2, not %q", version)
+	}
+}
+
+func TestNewerThanCached(t *testing.T) {
+	u := &Updater{
+		thingCache: map[string]*Thing{"1": {ID: "1", Version: "3"}},
+		deleted:    map[string]string{"2": "5", "3": ""},
+	}
+
+	cases := []struct {
+		id      string
+		version string
+		newer   bool
+	}{
+		{"1", "2", false},
+		{"1", "3", false},
+		{"1", "4", true},
+		{"2", "0", false},
+		{"2", "5", false},
+		{"2", "6", true},
+		{"3", "100", false},
+		{"4", "0", true},
+	}
+
+	for _, c := range cases {
+		newer, err := u.newerThanCached(&Thing{ID: c.id, Version: c.version})
+		if err != nil {
+			t.Errorf("%s at version %s: %s", c.id, c.version, err)
+			continue
+		}
+
+		if newer != c.newer {
+			t.Errorf("%s at version %s: expected newer to be %t", c.id, c.version, c.newer)
+		}
+	}
+}
+
+// results reads every command result on the response topic, by command id
+func results(t *testing.T, kc *KafkaClient, topic string) map[string]*CommandResult {
+	marks, err := kc.HighWaterMarks(topic)
+	if err != nil {
+		t.Fatalf("failed to get the marks of %s: %s", topic, err)
+	}
+
+	crs := make(map[string]*CommandResult)
+	err = broker.Replay(kc.b, topic, nil, marks, 5*time.Second, func(cm *sarama.ConsumerMessage) bool {
+		cr, err := ExtractCommandResultFromMessage(cm)
+		if err == nil {
+			crs[cr.CommandID] = cr
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", topic, err)
+	}
+
+	return crs
+}
+
+func TestIdempotentCreates(t *testing.T) {
+	b := broker.NewMemory(broker.MemoryPartitions)
+	kc := NewKafkaClient(b, "things", "commands", "responses", "")
+
+	c := &UpdaterConfig{
+		NewTopic:      "things",
+		CommandTopic:  "commands",
+		ResponseTopic: "responses",
+		OwnsThings:    true,
+		OriginalTopic: "original",
+	}
+
+	u := startUpdater(t, kc, c)
+
+	create := func(key, name string, foo float64) *Command {
+		cmd, err := NewCommand(CreateCommand)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd.Name = name
+		cmd.Foo = foo
+		cmd.IdempotencyKey = key
+		cmd.RequestHash = CreateRequestHash(name, foo)
+
+		u.HandleCommand(cmd)
+		return cmd
+	}
+
+	first := create("k", "one", 1)
+	retry := create("k", "one", 1)
+	reused := create("k", "two", 2)
+
+	crs := results(t, kc, c.ResponseTopic)
+
+	if crs[first.ID] == nil || crs[first.ID].Status != CommandSucceeded {
+		t.Fatalf("first create didn't succeed: %+v", crs[first.ID])
+	}
+
+	if cr := crs[retry.ID]; cr == nil || !cr.Replayed || cr.Thing.ID != crs[first.ID].Thing.ID {
+		t.Errorf("retry wasn't replayed from the first create: %+v", cr)
+	}
+
+	if cr := crs[reused.ID]; cr == nil || cr.Status != CommandFailed || cr.Code != 422 {
+		t.Errorf("reusing the key for a different create: got %+v, want a 422", cr)
+	}
+
+	u.mux.Lock()
+	u.idempotent["k"].FinishedOn = time.Now().Add(-IdempotencyWindow)
+	u.mux.Unlock()
+
+	go u.sweep(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	u.mux.Lock()
+	_, kept := u.idempotent["k"]
+	u.mux.Unlock()
+
+	if kept {
+		t.Errorf("the expired key wasn't swept")
+	}
+}
+
+func TestUpdaterForgetsExpiredCommands(t *testing.T) {
+	b := broker.NewMemory(broker.MemoryPartitions)
+	kc := NewKafkaClient(b, "things", "commands", "responses", "")
+
+	c := &UpdaterConfig{
+		NewTopic:      "things",
+		CommandTopic:  "commands",
+		ResponseTopic: "responses",
+		OwnsThings:    true,
+		OriginalTopic: "original",
+	}
+
+	u := startUpdater(t, kc, c)
+
+	u.HandleCommandResultFromMessage(&CommandResult{CommandID: "old", FinishedOn: time.Now().Add(-CommandRetention)})
+	u.HandleCommandResultFromMessage(&CommandResult{CommandID: "recent", FinishedOn: time.Now()})
+
+	u.mux.Lock()
+	_, old := u.doneCommands["old"]
+	u.doneCommands["recent"] = time.Now().Add(-CommandRetention)
+	u.mux.Unlock()
+
+	if old {
+		t.Errorf("an expired result was remembered")
+	}
+
+	go u.sweep(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	u.mux.Lock()
+	remembered := len(u.doneCommands)
+	u.mux.Unlock()
+
+	if remembered != 0 {
+		t.Errorf("%d expired commands weren't swept", remembered)
+	}
+
+	cmd, err := NewCommand(CreateCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Name = "late"
+	cmd.IssuedOn = time.Now().Add(-CommandRetention)
+
+	before := countMessages(t, kc, c.ResponseTopic)
+	u.HandleCommand(cmd)
+
+	if after := countMessages(t, kc, c.ResponseTopic); after != before {
+		t.Errorf("an expired command was applied")
+	}
+}